@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/seaweedfs/fuse"
+	"github.com/seaweedfs/fuse/fs"
+)
+
+const (
+	defaultUmask   = 0222
+	defaultRWUmask = 0022 // for a writable file system
+
+	// statfsBlockSize is the block size reported by Statfs.
+	statfsBlockSize = 4096
+)
+
+var _ fs.FSStatfser = &FS{}
+
+// setOwner sets the ownership and permissions in a
+// according to the config.
+func (f *FS) setOwner(a *fuse.Attr, mode os.FileMode) {
+	umask := uint32(defaultUmask)
+	if f.rw != nil {
+		umask = defaultRWUmask
+	}
+	if f.conf.Umask != nil {
+		umask = *f.conf.Umask
+	}
+
+	a.Uid = f.conf.UID
+	a.Gid = f.conf.GID
+	a.Mode = mode &^ os.FileMode(umask)
+}
+
+// dirStat returns the modification time of the directory n
+// (the latest time anything under it was saved)
+// and its link count.
+func (n *FSNode) dirStat(ctx context.Context) (time.Time, uint32, error) {
+	var extra uint32
+	if n == n.fs.top {
+		// The virtual directories.
+		extra = 2
+	}
+
+	if n.fs.idx == nil {
+		n.fs.treeMu.RLock()
+		defer n.fs.treeMu.RUnlock()
+
+		if n.nlink == 0 {
+			// The tree is still being built.
+			return n.timestamp, 2 + extra, nil
+		}
+		return n.timestamp, n.nlink + extra, nil
+	}
+
+	n.fs.treeMu.Lock()
+	defer n.fs.treeMu.Unlock()
+
+	if !n.statLoaded {
+		mtime, nsubdirs, err := indexDirStat(ctx, n.fs.idx, n.path)
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		n.timestamp = mtime
+		n.nlink = 2 + nsubdirs
+		n.statLoaded = true
+	}
+	return n.timestamp, n.nlink + extra, nil
+}
+
+// setDirStats sets the modification time and link count
+// of the directory n and every directory under it,
+// returning n's modification time.
+// The caller must hold n.fs.treeMu.
+func (n *FSNode) setDirStats() time.Time {
+	var (
+		mtime time.Time
+		nlink uint32 = 2
+	)
+	for _, child := range n.children {
+		t := child.timestamp
+		if child.isDir() {
+			t = child.setDirStats()
+			nlink++
+		}
+		if t.After(mtime) {
+			mtime = t
+		}
+	}
+	n.timestamp = mtime
+	n.nlink = nlink
+	return mtime
+}
+
+// indexDirStat returns the latest time anything under dir was saved,
+// and the number of subdirectories of dir,
+// according to an index.
+func indexDirStat(ctx context.Context, db *sql.DB, dir string) (time.Time, uint32, error) {
+	var (
+		ts  sql.NullInt64
+		row *sql.Row
+	)
+	if dir == "" {
+		row = db.QueryRowContext(ctx, "SELECT MAX(timestamp) FROM paths")
+	} else {
+		// Everything under dir is in the range [dir/, dir0),
+		// since 0 is the character after /.
+		row = db.QueryRowContext(ctx, "SELECT MAX(timestamp) FROM paths WHERE dir = ? OR (dir >= ? AND dir < ?)", dir, dir+"/", dir+"0")
+	}
+	if err := row.Scan(&ts); err != nil {
+		return time.Time{}, 0, errors.Wrapf(err, "querying index for mtime of %s", dir)
+	}
+
+	var nsubdirs uint32
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM dirs WHERE dir = ?", dir).Scan(&nsubdirs); err != nil {
+		return time.Time{}, 0, errors.Wrapf(err, "querying index for subdirs of %s", dir)
+	}
+
+	var mtime time.Time
+	if ts.Valid {
+		mtime = time.Unix(ts.Int64, 0)
+	}
+	return mtime, nsubdirs, nil
+}
+
+// Statfs reports the storage used by the objects in the file system,
+// counting each object once.
+// For a file system loaded from an index, that is every object in the bucket.
+// Otherwise it is the objects of the files in the served tree,
+// or nothing until the tree has been built.
+// In a writable file system,
+// the free space is that of the staging directory,
+// where written files are kept until they are saved.
+func (f *FS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	var size, count uint64
+
+	if f.idx != nil {
+		f.treeMu.RLock()
+		err := f.idx.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(size), 0) FROM objects").Scan(&count, &size)
+		f.treeMu.RUnlock()
+		if err != nil {
+			return errors.Wrap(err, "querying index for totals")
+		}
+	} else {
+		select {
+		case <-f.built:
+			hashes, err := f.hashIndex()
+			if err != nil {
+				return err
+			}
+			f.treeMu.RLock()
+			for _, nodes := range hashes {
+				size += nodes[0].size
+			}
+			f.treeMu.RUnlock()
+			count = uint64(len(hashes))
+		default:
+			// Still building.
+		}
+	}
+
+	resp.Bsize = statfsBlockSize
+	resp.Frsize = statfsBlockSize
+	resp.Blocks = (size + statfsBlockSize - 1) / statfsBlockSize
+	if f.rw != nil {
+		free, avail, err := diskSpace(f.rw.stageDir)
+		if err != nil {
+			return errors.Wrapf(err, "getting free space in %s", f.rw.stageDir)
+		}
+		resp.Bfree = free / statfsBlockSize
+		resp.Bavail = avail / statfsBlockSize
+		// The used space is Blocks minus Bfree.
+		resp.Blocks += resp.Bfree
+	}
+	resp.Files = count
+	resp.Namelen = 255
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/seaweedfs/fuse"
+)
+
+// TestStatfsWhileSettling checks (when run with -race)
+// that Statfs reads file sizes safely
+// while files written through the file system are settling.
+func TestStatfsWhileSettling(t *testing.T) {
+	ctx := context.Background()
+
+	hash := "sha256-ab0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcd"
+
+	listfile := filepath.Join(t.TempDir(), "list.json")
+	j, err := json.Marshal(listType{
+		Hash:  hash,
+		Size:  42,
+		Paths: map[string]time.Time{"/a/x": time.Unix(1700000000, 0)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(listfile, j, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := newFS(ctx, nil, retryConf{}, listfile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.wait(); err != nil {
+		t.Fatal(err)
+	}
+	if f.rw, err = newRWState(maincmd{}, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	n, err := f.root.findNode("a/x", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := f.Statfs(ctx, &fuse.StatfsRequest{}, &fuse.StatfsResponse{}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		st, err := f.rw.newStage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := st.file.Write(make([]byte, i)); err != nil {
+			t.Fatal(err)
+		}
+		// As if the content had just been saved.
+		st.name = hash
+
+		f.treeMu.Lock()
+		n.stage = st
+		f.treeMu.Unlock()
+		f.rw.track(st, n)
+
+		n.settle(st)
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/singleflight"
+)
+
+// cacheConf configures the on-disk block cache used by the FUSE filesystem.
+type cacheConf struct {
+	Dir   string `yaml:"dir"`   // where to keep cached blocks; "" disables the cache
+	Size  uint64 `yaml:"size"`  // the most space cached blocks may use
+	Block uint64 `yaml:"block"` // the size of a block
+}
+
+const (
+	defaultCacheSize  = 1 << 30
+	defaultCacheBlock = 4 << 20
+)
+
+// blockCache is a size-limited cache of fixed-size blocks of bucket objects,
+// stored as files in a local directory.
+// When the cache is full,
+// the least recently used blocks are evicted.
+type blockCache struct {
+	dir       string
+	limit     int64
+	blockSize int64
+
+	// fetches makes concurrent reads of the same uncached block,
+	// such as by a prefetch and a read that catches up with it,
+	// fetch it from the bucket only once.
+	fetches singleflight.Group
+
+	mu      sync.Mutex // protects the fields below
+	size    int64
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// newBlockCache creates a block cache in the given directory,
+// adopting any blocks left there by an earlier run.
+func newBlockCache(conf cacheConf) (*blockCache, error) {
+	c := &blockCache{
+		dir:       conf.Dir,
+		limit:     int64(conf.Size),
+		blockSize: int64(conf.Block),
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element),
+	}
+	if c.limit == 0 {
+		c.limit = defaultCacheSize
+	}
+	if c.blockSize == 0 {
+		c.blockSize = defaultCacheBlock
+	}
+
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "creating cache dir %s", c.dir)
+	}
+	dirents, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading cache dir %s", c.dir)
+	}
+
+	type found struct {
+		cacheEntry
+		mtime int64
+	}
+	var blocks []found
+	for _, dirent := range dirents {
+		name := dirent.Name()
+		if !dirent.Type().IsRegular() {
+			continue
+		}
+		if strings.HasSuffix(name, ".tmp") || !c.validKey(name) {
+			// Left over from an interrupted write,
+			// or from a run with a different block size.
+			os.Remove(filepath.Join(c.dir, name))
+			continue
+		}
+		info, err := dirent.Info()
+		if err != nil {
+			continue
+		}
+		blocks = append(blocks, found{cacheEntry: cacheEntry{key: name, size: info.Size()}, mtime: info.ModTime().UnixNano()})
+	}
+
+	// Treat the most recently written blocks as the most recently used.
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].mtime > blocks[j].mtime })
+	for _, b := range blocks {
+		e := b.cacheEntry
+		c.entries[e.key] = c.lru.PushBack(&e)
+		c.size += e.size
+	}
+	c.evict()
+
+	return c, nil
+}
+
+// blockKey is the name of the cache file holding block i of the named object.
+// The block size is included so that blocks cached with a different size are not used.
+func (c *blockCache) blockKey(hash string, i int64) string {
+	return fmt.Sprintf("%s-%d-%d", hash, c.blockSize, i)
+}
+
+// validKey tells whether name could have come from blockKey with the current block size.
+func (c *blockCache) validKey(name string) bool {
+	parts := strings.Split(name, "-")
+	if len(parts) != 4 || !isHash(parts[0]+"-"+parts[1]) || parts[2] != strconv.FormatInt(c.blockSize, 10) {
+		return false
+	}
+	_, err := strconv.ParseInt(parts[3], 10, 64)
+	return err == nil
+}
+
+// get returns the cached block with the given key,
+// or nil if there isn't one.
+// A cached block that is not the expected size is discarded.
+func (c *blockCache) get(key string, size int64) []byte {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(c.dir, key))
+	if err != nil {
+		log.Printf("Reading cached block %s: %s", key, err)
+		c.remove(key)
+		return nil
+	}
+	if int64(len(data)) != size {
+		log.Printf("Discarding cached block %s: got %d bytes, want %d", key, len(data), size)
+		c.remove(key)
+		os.Remove(filepath.Join(c.dir, key))
+		return nil
+	}
+	return data
+}
+
+// put adds a block to the cache,
+// evicting others as needed to stay within the size limit.
+// Failures are logged and otherwise ignored.
+func (c *blockCache) put(key string, data []byte) {
+	if err := c.write(key, data); err != nil {
+		log.Printf("Caching block %s: %s", key, err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.size -= el.Value.(*cacheEntry).size
+		c.lru.Remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: int64(len(data))})
+	c.size += int64(len(data))
+	c.evict()
+}
+
+// write writes a block to its file in the cache directory.
+// It is written to a uniquely named temporary file first,
+// so that the block file is never seen partly written.
+func (c *blockCache) write(key string, data []byte) error {
+	f, err := os.CreateTemp(c.dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // a no-op after the rename
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(c.dir, key))
+}
+
+func (c *blockCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.size -= el.Value.(*cacheEntry).size
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+// evict removes least recently used blocks until the cache is within its size limit.
+// The caller must hold c.mu.
+func (c *blockCache) evict() {
+	for c.size > c.limit {
+		el := c.lru.Back()
+		if el == nil {
+			return
+		}
+		e := el.Value.(*cacheEntry)
+		if err := os.Remove(filepath.Join(c.dir, e.key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Evicting cached block %s: %s", e.key, err)
+		}
+		c.size -= e.size
+		c.lru.Remove(el)
+		delete(c.entries, e.key)
+	}
+}
+
+// readBlock returns block i of the file at n,
+// from the cache if possible,
+// otherwise from the bucket
+// (adding it to the cache).
+func (n *FSNode) readBlock(ctx context.Context, i int64) ([]byte, error) {
+	c := n.fs.cache
+
+	offset := i * c.blockSize
+	length := c.blockSize
+	if rest := int64(n.size) - offset; rest < length {
+		length = rest
+	}
+	if length <= 0 {
+		return nil, nil
+	}
+
+	key := c.blockKey(n.hash, i)
+	if data := c.get(key, length); data != nil {
+		return data, nil
+	}
+
+	ch := c.fetches.DoChan(key, func() (any, error) {
+		// Another read may have fetched the block since it was looked for above.
+		if data := c.get(key, length); data != nil {
+			return data, nil
+		}
+
+		// The fetch is shared with any other reads of the block,
+		// so it must not end just because this one is canceled.
+		ctx := context.WithoutCancel(ctx)
+
+		var (
+			buf  = make([]byte, length)
+			nbuf int
+		)
+
+		// On retry, reading resumes at the offset where the failure happened.
+		err := withRetries(n.fs.conf.Retry.newBackoff(ctx), func() error {
+			r, err := n.fs.objects.NewRangeReader(ctx, n.hash, offset+int64(nbuf), length-int64(nbuf))
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+
+			nbytes, err := io.ReadFull(r, buf[nbuf:])
+			nbuf += nbytes
+			return err
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading block %d of %s", i, n.hash)
+		}
+
+		c.put(key, buf)
+		return buf, nil
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]byte), nil
+	}
+}
+
+// readCached reads size bytes of the file at n, starting at offset,
+// by way of the block cache.
+// The result is short only if it reaches the end of the file.
+func (n *FSNode) readCached(ctx context.Context, offset, size int64) ([]byte, error) {
+	if end := int64(n.size); offset+size > end {
+		size = end - offset
+	}
+	if size <= 0 {
+		return nil, nil
+	}
+
+	var (
+		bs     = n.fs.cache.blockSize
+		result = make([]byte, 0, size)
+	)
+	for i := offset / bs; int64(len(result)) < size; i++ {
+		block, err := n.readBlock(ctx, i)
+		if err != nil {
+			return nil, err
+		}
+		if len(block) == 0 {
+			break
+		}
+		start := offset + int64(len(result)) - i*bs
+		if start >= int64(len(block)) {
+			break
+		}
+		block = block[start:]
+		if need := size - int64(len(result)); int64(len(block)) > need {
+			block = block[:need]
+		}
+		result = append(result, block...)
+	}
+	return result, nil
+}
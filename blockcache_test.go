@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestReadCached(t *testing.T) {
+	const blockSize = 4096
+
+	var (
+		ctx  = context.Background()
+		rnd  = rand.New(rand.NewSource(5))
+		size = 20*blockSize + 123 // the last block is partial
+		data = randomBytes(rnd, size)
+		fake = newFakeObjects(true, map[string][]byte{"obj": data})
+	)
+	f, nodes := newTestFS(fake)
+
+	// Small enough that blocks are evicted and fetched again.
+	var err error
+	f.cache, err = newBlockCache(cacheConf{Dir: t.TempDir(), Size: 8 * blockSize, Block: blockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := nodes["obj"]
+
+	check := func(offset int64, size int) {
+		t.Helper()
+
+		got, err := n.readCached(ctx, offset, int64(size))
+		if err != nil {
+			t.Fatalf("reading %d bytes at %d: %s", size, offset, err)
+		}
+		if want := wantRange(data, offset, size); !bytes.Equal(got, want) {
+			t.Fatalf("reading %d bytes at %d: got %d bytes, want %d (content equal: %v)", size, offset, len(got), len(want), bytes.Equal(got, want))
+		}
+	}
+
+	// Across each block boundary.
+	for i := int64(1); i*blockSize < int64(size); i++ {
+		check(i*blockSize-1, 2)
+		check(i*blockSize-10, blockSize+20)
+	}
+
+	// Spanning several blocks.
+	check(blockSize/2, 3*blockSize)
+
+	// The final, partial block.
+	last := int64(size) / blockSize * blockSize
+	check(last, blockSize)
+	check(last+100, 100)
+	check(last-1, blockSize)
+
+	// At and past the end.
+	check(int64(size), 100)
+	check(int64(size)+blockSize, 100)
+
+	for i := 0; i < 1000; i++ {
+		check(rnd.Int63n(int64(size)+100), rnd.Intn(5*blockSize))
+	}
+}
+
+func TestReadBlockConcurrent(t *testing.T) {
+	const blockSize = 4096
+
+	var (
+		ctx  = context.Background()
+		rnd  = rand.New(rand.NewSource(6))
+		size = 3*blockSize + 10
+		data = randomBytes(rnd, size)
+		fake = newFakeObjects(false, map[string][]byte{"obj": data})
+	)
+	f, nodes := newTestFS(fake)
+
+	var err error
+	f.cache, err = newBlockCache(cacheConf{Dir: t.TempDir(), Block: blockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := nodes["obj"]
+
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, 40)
+	)
+	for j := 0; j < 10; j++ {
+		for i := int64(0); i < 4; i++ {
+			i := i
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				block, err := n.readBlock(ctx, i)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if want := wantRange(data, i*blockSize, blockSize); !bytes.Equal(block, want) {
+					errs <- fmt.Errorf("block %d: got %d bytes, want %d", i, len(block), len(want))
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if fake.opens != 4 {
+		t.Errorf("got %d fetches from the bucket, want 4", fake.opens)
+	}
+}
+
+func TestReadBlockTruncated(t *testing.T) {
+	const blockSize = 4096
+
+	var (
+		ctx  = context.Background()
+		rnd  = rand.New(rand.NewSource(7))
+		size = 2*blockSize + 10
+		data = randomBytes(rnd, size)
+		fake = newFakeObjects(false, map[string][]byte{"obj": data})
+	)
+	f, nodes := newTestFS(fake)
+
+	var err error
+	f.cache, err = newBlockCache(cacheConf{Dir: t.TempDir(), Block: blockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := nodes["obj"]
+
+	for i := int64(0); i < 3; i++ {
+		if _, err := n.readBlock(ctx, i); err != nil {
+			t.Fatal(err)
+		}
+		// Damage the cached copy of the block.
+		filename := filepath.Join(f.cache.dir, f.cache.blockKey("obj", i))
+		if err := os.Truncate(filename, 5); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := n.readCached(ctx, 0, int64(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes, want %d (content equal: %v)", len(got), len(data), bytes.Equal(got, data))
+	}
+	if fake.opens != 6 {
+		t.Errorf("got %d fetches from the bucket, want 6", fake.opens)
+	}
+}
+
+func TestReadBlockCanceled(t *testing.T) {
+	const blockSize = 4096
+
+	var (
+		rnd  = rand.New(rand.NewSource(8))
+		data = randomBytes(rnd, blockSize)
+		fake = newFakeObjects(false, map[string][]byte{"obj": data})
+	)
+	fake.hold = make(chan struct{})
+	f, nodes := newTestFS(fake)
+
+	var err error
+	f.cache, err = newBlockCache(cacheConf{Dir: t.TempDir(), Block: blockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := nodes["obj"]
+
+	// Start a read of the block, and wait for it to reach the bucket.
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	defer cancel1()
+	err1 := make(chan error, 1)
+	go func() {
+		_, err := n.readBlock(ctx1, 0)
+		err1 <- err
+	}()
+	for {
+		fake.mu.Lock()
+		holding := fake.holding
+		fake.mu.Unlock()
+		if holding > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Start another read of the same block, which waits for the first one's fetch.
+	type result struct {
+		block []byte
+		err   error
+	}
+	res2 := make(chan result, 1)
+	go func() {
+		block, err := n.readBlock(context.Background(), 0)
+		res2 <- result{block: block, err: err}
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Canceling the first read ends it right away...
+	cancel1()
+	if err := <-err1; !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v from the canceled read, want %v", err, context.Canceled)
+	}
+
+	// ...but not the fetch that the second read is waiting for.
+	close(fake.hold)
+	r := <-res2
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if !bytes.Equal(r.block, data) {
+		t.Errorf("got %d bytes, want %d", len(r.block), len(data))
+	}
+	if fake.opens != 1 {
+		t.Errorf("got %d fetches from the bucket, want 1", fake.opens)
+	}
+}
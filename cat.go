@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+func (c maincmd) doCat(ctx context.Context, listfile string, offset, length int64, which string, _ []string) error {
+	hash, _, err := c.resolveFile(ctx, listfile, which)
+	if err != nil {
+		return err
+	}
+	return c.copyObject(ctx, os.Stdout, hash, offset, length)
+}
+
+func (c maincmd) doGet(ctx context.Context, listfile string, offset, length int64, which, dest string, _ []string) error {
+	hash, node, err := c.resolveFile(ctx, listfile, which)
+	if err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		base := hash
+		if node != nil {
+			base = filepath.Base(node.path)
+		}
+		dest = filepath.Join(dest, base)
+	}
+
+	// Write to a temporary file and rename it into place only after it is verified,
+	// so a failed get never leaves a partial file at dest.
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".gcsbackup-get-*")
+	if err != nil {
+		return errors.Wrapf(err, "creating temporary file for %s", dest)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := c.copyObject(ctx, tmp, hash, offset, length); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		return errors.Wrapf(err, "setting mode of %s", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "closing %s", tmp.Name())
+	}
+	if node != nil {
+		if err := os.Chtimes(tmp.Name(), node.timestamp, node.timestamp); err != nil {
+			return errors.Wrapf(err, "setting times of %s", tmp.Name())
+		}
+	}
+	return errors.Wrapf(os.Rename(tmp.Name(), dest), "renaming %s to %s", tmp.Name(), dest)
+}
+
+// resolveFile finds the object for a file given either as a hash
+// or as a path
+// (as recorded, e.g. HOST:/PATH, or as in the filesystem tree, e.g. HOST/PATH).
+// In the latter case it also returns the file's node in the prescan tree,
+// built from listfile or (if listfile is "") a scan of the bucket.
+// Where more than one version has been saved at a path,
+// the most recent one is used.
+func (c maincmd) resolveFile(ctx context.Context, listfile, which string) (string, *FSNode, error) {
+	if isHash(which) {
+		return which, nil, nil
+	}
+
+	f, err := newFS(ctx, c.bucket, c.retry, listfile, "")
+	if err != nil {
+		return "", nil, errors.Wrap(err, "building prescan tree")
+	}
+	if err := f.wait(); err != nil {
+		return "", nil, errors.Wrap(err, "building prescan tree")
+	}
+	node, err := f.root.findNode(treePath(which), false)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "finding %s", which)
+	}
+	if node.isDir() {
+		return "", nil, fmt.Errorf("%s is a directory", which)
+	}
+	return node.hash, node, nil
+}
+
+// isHash tells whether s is the name of an object in the bucket.
+func isHash(s string) bool {
+	h := strings.TrimPrefix(s, "sha256-")
+	if h == s || len(h) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(h)
+	return err == nil
+}
+
+// copyObject writes the content of the named object to w,
+// starting at offset and continuing for length bytes
+// (or to the end, if length is negative).
+// When the whole object is copied,
+// its content is checked against its name.
+// On retry, copying resumes where the failure happened.
+func (c maincmd) copyObject(ctx context.Context, w io.Writer, name string, offset, length int64) error {
+	var hasher hash.Hash
+	if offset == 0 && length < 0 {
+		hasher = sha256.New()
+		w = io.MultiWriter(w, hasher)
+	}
+
+	var written int64
+	err := withRetries(c.retry.newBackoff(ctx), func() error {
+		remaining := int64(-1)
+		if length >= 0 {
+			remaining = length - written
+		}
+		r, err := c.bucket.Object(name).NewRangeReader(ctx, offset+written, remaining)
+		if err != nil {
+			return errors.Wrapf(err, "opening %s", name)
+		}
+		defer r.Close()
+
+		n, err := io.Copy(w, r)
+		written += n
+		return errors.Wrapf(err, "reading %s", name)
+	})
+	if err != nil {
+		return err
+	}
+
+	if hasher != nil {
+		if got := "sha256-" + hex.EncodeToString(hasher.Sum(nil)); got != name {
+			return errors.Wrapf(errChecksumMismatch, "reading %s: content has hash %s", name, got)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+)
+
+// usage is the storage used by a subtree of the file system.
+type usage struct {
+	Path    string  `json:"path"`
+	Files   int     `json:"files"`   // number of paths
+	Objects int     `json:"objects"` // number of distinct hashes
+	Logical int64   `json:"logical"` // sum of file sizes over all paths
+	Unique  int64   `json:"unique"`  // sum of sizes with each hash counted once
+	Ratio   float64 `json:"ratio"`   // logical / unique
+}
+
+func (c maincmd) doDU(ctx context.Context, listfile, dir string, depth, top int, format string, _ []string) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown format %s (want text or json)", format)
+	}
+
+	f, err := newFS(ctx, c.bucket, c.retry, listfile, "")
+	if err != nil {
+		return errors.Wrap(err, "building filesystem")
+	}
+	if err := f.wait(); err != nil {
+		return errors.Wrap(err, "building filesystem")
+	}
+	if dir != "" {
+		if err := f.serveDir(dir); err != nil {
+			return err
+		}
+	}
+
+	var dirs []usage
+	_, total, err := f.top.du(0, depth, &dirs)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(dirs, func(i, j int) bool {
+		if dirs[i].Unique != dirs[j].Unique {
+			return dirs[i].Unique > dirs[j].Unique
+		}
+		return dirs[i].Path < dirs[j].Path
+	})
+	if top > 0 && len(dirs) > top {
+		dirs = dirs[:top]
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		out := struct {
+			Total usage   `json:"total"`
+			Dirs  []usage `json:"dirs"`
+		}{
+			Total: total,
+			Dirs:  dirs,
+		}
+		return errors.Wrap(enc.Encode(out), "JSON-encoding output")
+	}
+
+	fmt.Printf("%d files, %d objects\n", total.Files, total.Objects)
+	fmt.Printf("Logical size %s, unique size %s, dedup ratio %.2f\n", humanize.IBytes(uint64(total.Logical)), humanize.IBytes(uint64(total.Unique)), total.Ratio)
+	if len(dirs) == 0 {
+		return nil
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "UNIQUE\tLOGICAL\tRATIO\tFILES\t\tPATH")
+	for _, u := range dirs {
+		fmt.Fprintf(w, "%s\t%s\t%.2f\t%d\t\t%s\n", humanize.IBytes(uint64(u.Unique)), humanize.IBytes(uint64(u.Logical)), u.Ratio, u.Files, "/"+u.Path)
+	}
+	return w.Flush()
+}
+
+// du computes the storage used by the subtree at n,
+// which is at the given level below the top of the report.
+// It returns the set of hashes in the subtree (with their sizes)
+// and the resulting totals.
+// Subdirectories at levels 1 through maxDepth are added to dirs.
+func (n *FSNode) du(level, maxDepth int, dirs *[]usage) (map[string]int64, usage, error) {
+	if !n.isDir() {
+		return map[string]int64{n.hash: int64(n.size)}, usage{Path: n.path, Files: 1, Logical: int64(n.size)}, nil
+	}
+
+	if err := n.load(); err != nil {
+		return nil, usage{}, errors.Wrapf(err, "loading %s", n.path)
+	}
+
+	var (
+		hashes map[string]int64
+		u      = usage{Path: n.path}
+	)
+	for _, child := range n.children {
+		childHashes, childUsage, err := child.du(level+1, maxDepth, dirs)
+		if err != nil {
+			return nil, usage{}, err
+		}
+		u.Files += childUsage.Files
+		u.Logical += childUsage.Logical
+
+		// Merge the smaller set into the larger one.
+		if len(childHashes) > len(hashes) {
+			hashes, childHashes = childHashes, hashes
+		}
+		for h, size := range childHashes {
+			hashes[h] = size
+		}
+	}
+	if hashes == nil {
+		hashes = make(map[string]int64)
+	}
+
+	u.Objects = len(hashes)
+	for _, size := range hashes {
+		u.Unique += size
+	}
+	if u.Unique > 0 {
+		u.Ratio = float64(u.Logical) / float64(u.Unique)
+	}
+
+	if level > 0 && level <= maxDepth {
+		*dirs = append(*dirs, u)
+	}
+
+	return hashes, u, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sighting is one occurrence of a path in the bucket:
+// the object it was saved as, and when.
+type sighting struct {
+	hash      string
+	size      int64
+	timestamp time.Time
+}
+
+func (c maincmd) doFind(ctx context.Context, listfile, glob, regex string, minSize, maxSize int64, since, until, hash string, _ []string) error {
+	filter, err := newListFilter("", since, until, minSize, hash)
+	if err != nil {
+		return err
+	}
+	filter.maxSize = maxSize
+	if glob != "" {
+		if _, err := path.Match(glob, ""); err != nil {
+			return errors.Wrapf(err, "in glob pattern %s", glob)
+		}
+		filter.glob = glob
+	}
+	if regex != "" {
+		if filter.regex, err = regexp.Compile(regex); err != nil {
+			return errors.Wrapf(err, "compiling regex %s", regex)
+		}
+	}
+	if filter.empty() {
+		return fmt.Errorf("no search criteria given")
+	}
+
+	found, err := findPaths(ctx, c, listfile, filter)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Println(key)
+		for _, s := range found[key] {
+			fmt.Printf("  %s  %s  %d bytes\n", s.timestamp.Format(time.RFC3339), s.hash, s.size)
+		}
+	}
+
+	if len(keys) == 0 {
+		fmt.Fprintln(os.Stderr, "No matches")
+	}
+
+	return nil
+}
+
+// findPaths returns every sighting of each path selected by filter,
+// in chronological order,
+// taken from a list file, an index, or (if listfile is "") a scan of the bucket.
+func findPaths(ctx context.Context, c maincmd, listfile string, filter *listFilter) (map[string][]sighting, error) {
+	found := make(map[string][]sighting)
+	err := forEachListEntry(ctx, c.bucket, c.retry, listfile, func(l listType) error {
+		l, ok := filter.apply(l)
+		if !ok {
+			return nil
+		}
+		for key, t := range l.Paths {
+			found[key] = append(found[key], sighting{hash: l.Hash, size: l.Size, timestamp: t})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, sightings := range found {
+		sort.Slice(sightings, func(i, j int) bool {
+			return sightings[i].timestamp.Before(sightings[j].timestamp)
+		})
+	}
+	return found, nil
+}
@@ -2,20 +2,21 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"cloud.google.com/go/storage"
-	"github.com/bobg/gcsobj"
 	"github.com/pkg/errors"
-	"google.golang.org/api/iterator"
 	"gopkg.in/yaml.v3"
 
 	// These used to be bazil.org/fuse and bazil.org/fuse/fs,
@@ -25,20 +26,37 @@ import (
 	"github.com/seaweedfs/fuse/fs"
 )
 
-func (c maincmd) doFS(ctx context.Context, name, listfile, confFile, mountpoint string, _ []string) error {
-	start := time.Now()
+func (c maincmd) doFS(ctx context.Context, name, listfile, confFile, dir string, refresh time.Duration, rw bool, mountpoint string, _ []string) error {
+	if rw && listfile != "" {
+		// The list file or index would not reflect changes made through the file system,
+		// and refreshing from it would undo them.
+		return fmt.Errorf("-rw cannot be used with -list")
+	}
 
-	log.Print("Building file system, please wait")
-	f, err := newFS(ctx, c.bucket, listfile, confFile)
+	f, err := newFS(ctx, c.bucket, c.retry, listfile, confFile)
 	if err != nil {
 		return errors.Wrap(err, "building filesystem")
 	}
+	if dir != "" {
+		// This waits for the tree to be loaded,
+		// unless it comes from an index.
+		if err := f.serveDir(dir); err != nil {
+			return err
+		}
+	}
 
 	opts := []fuse.MountOption{
 		fuse.FSName(name),
-		fuse.ReadOnly(),
 		fuse.Subtype("gcsbackup"),
 	}
+	if rw {
+		if f.rw, err = newRWState(c, f.conf.Stage); err != nil {
+			return err
+		}
+		defer f.finishRW(ctx)
+	} else {
+		opts = append(opts, fuse.ReadOnly())
+	}
 	if !f.conf.Browse {
 		opts = append(opts, fuse.NoBrowse())
 	}
@@ -49,24 +67,91 @@ func (c maincmd) doFS(ctx context.Context, name, listfile, confFile, mountpoint
 	}
 	defer conn.Close()
 
-	log.Printf("File system built in %s, now serving", time.Since(start))
-	return fs.Serve(conn, f)
+	f.server = fs.New(conn, nil)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go f.refreshLoop(ctx, refresh)
+
+	log.Print("Now serving")
+	return f.server.Serve(f)
 }
 
 type FS struct {
 	bucket *storage.BucketHandle
+	from   string // the list file or index the tree comes from, or "" for the bucket
 	root   *FSNode
+	top    *FSNode // the node served as the root of the file system; normally the same as root
+
+	objects objectReader // for reading the content of files from the bucket
 
-	conf fsConf
+	server *fs.Server // for invalidating kernel caches when the tree is refreshed; nil if not serving
 
-	mu        sync.Mutex // protects nextInode
-	nextInode uint64
+	conf  fsConf
+	cache *blockCache // nil if there is no block cache
+
+	// If non-nil, directories are populated lazily from this index
+	// (see FSNode.load).
+	idx    *sql.DB
+	treeMu sync.RWMutex // protects lazy loading of directories, and changes made by refresh or through the file system
+
+	// Otherwise the tree is built in the background,
+	// and this is closed when that is done
+	// (see FS.wait).
+	built    chan struct{}
+	buildErr error
+
+	// These support the virtual directories at the top of the file system
+	// (see hashviews.go).
+	byHash *byHashDir
+	hashMu sync.Mutex           // protects hashes
+	hashes map[string][]*FSNode // files by hash; nil until needed, and after each refresh
+
+	mu     sync.Mutex          // protects inodes
+	inodes map[uint64]inodeKey // the node to which each inode number has been given (see inodeFor)
+
+	hosts map[string]bool // the host namespaces seen while building the tree (see keyFor)
+
+	rw *rwState // non-nil if the file system is writable (see rw.go)
 }
 
 type fsConf struct {
-	Large  uint64 `yaml:"large"`
-	Chunk  uint64 `yaml:"chunk"`
-	Browse bool   `yaml:"browse"`
+	Large  uint64    `yaml:"large"`
+	Chunk  uint64    `yaml:"chunk"`
+	Browse bool      `yaml:"browse"`
+	Retry  retryConf `yaml:"retry"`
+	Cache  cacheConf `yaml:"cache"`
+
+	// These set the ownership and permissions of files and dirs.
+	// A nil Umask means the default,
+	// which depends on whether the file system is writable.
+	UID   uint32  `yaml:"uid"`
+	GID   uint32  `yaml:"gid"`
+	Umask *uint32 `yaml:"umask"`
+
+	// Readahead is how far ahead of sequential reads to fetch file data.
+	// If it is 0, files are instead read in full on first access.
+	Readahead uint64 `yaml:"readahead"`
+
+	// Stage is where files written to a writable file system are kept until they are saved.
+	// If it is empty, a temporary directory is used.
+	Stage string `yaml:"stage"`
+}
+
+// objectReader opens byte ranges of bucket objects for reading.
+// The file system reads file content through one of these,
+// which is a bucketReader except in tests.
+type objectReader interface {
+	NewRangeReader(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
+}
+
+// bucketReader is the objectReader for a bucket.
+type bucketReader struct {
+	bucket *storage.BucketHandle
+}
+
+func (b bucketReader) NewRangeReader(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	return b.bucket.Object(name).NewRangeReader(ctx, offset, length)
 }
 
 const (
@@ -76,21 +161,28 @@ const (
 
 var _ fs.FS = &FS{}
 
-func newFS(ctx context.Context, bucket *storage.BucketHandle, fromfile, confFile string) (*FS, error) {
+func newFS(ctx context.Context, bucket *storage.BucketHandle, retry retryConf, fromfile, confFile string) (*FS, error) {
 	f := &FS{
-		bucket:    bucket,
-		nextInode: 2,
+		bucket:  bucket,
+		objects: bucketReader{bucket: bucket},
+		from:    fromfile,
+		inodes:  make(map[uint64]inodeKey),
+		hosts:   make(map[string]bool),
 
 		conf: fsConf{
 			Large: defaultLargeRead,
 			Chunk: defaultChunkRead,
+			Retry: retry,
+
+			UID: uint32(os.Getuid()),
+			GID: uint32(os.Getgid()),
+
+			Readahead: defaultReadahead,
 		},
 	}
-	f.root = &FSNode{
-		fs:       f,
-		inode:    1,
-		children: make(map[string]*FSNode),
-	}
+	f.root = f.newRoot()
+	f.top = f.root
+	f.byHash = &byHashDir{fs: f}
 
 	if confFile != "" {
 		conf, err := os.Open(confFile)
@@ -109,148 +201,325 @@ func newFS(ctx context.Context, bucket *storage.BucketHandle, fromfile, confFile
 		}
 	}
 
+	if f.conf.Cache.Dir != "" {
+		var err error
+		if f.cache, err = newBlockCache(f.conf.Cache); err != nil {
+			return nil, err
+		}
+	}
+
+	if ok, err := isIndexFile(fromfile); err != nil {
+		return nil, errors.Wrapf(err, "checking type of %s", fromfile)
+	} else if ok {
+		// Populate the filesystem lazily from an index.
+		f.idx, err = openIndex(fromfile)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+
+	// Build the tree in the background,
+	// so the file system can be mounted right away.
+	// Neither the bucket nor a list file is ordered by path,
+	// so no directory is known to be complete until all of it has been read:
+	// operations needing the tree,
+	// even a lookup or listing at the top of it,
+	// wait for it to be built (see FSNode.load).
+	// Only an index is loaded lazily.
+	f.built = make(chan struct{})
+	go func() {
+		defer close(f.built)
+
+		start := time.Now()
+		log.Print("Building file system (operations wait until this is done; an index from list -db would be loaded lazily instead)")
+		if f.buildErr = f.build(ctx, fromfile); f.buildErr != nil {
+			log.Printf("Building file system: %s", f.buildErr)
+			return
+		}
+
+		f.treeMu.Lock()
+		f.root.setDirStats()
+		f.treeMu.Unlock()
+
+		log.Printf("File system built in %s", time.Since(start))
+	}()
+
+	return f, nil
+}
+
+// build populates the tree from a file of list output,
+// or (if fromfile is "") a scan of the bucket.
+func (f *FS) build(ctx context.Context, fromfile string) error {
 	if fromfile == "" {
 		// Build filesystem from a scan of the bucket.
 
-		var (
-			query = &storage.Query{Projection: storage.ProjectionNoACL}
-			it    = f.bucket.Objects(ctx, query)
-		)
-		for {
-			attrs, err := it.Next()
-			if errors.Is(err, iterator.Done) {
-				return f, nil
-			}
-			if err != nil {
-				return nil, errors.Wrap(err, "iterating through bucket objects")
-			}
+		return forEachObject(ctx, f.bucket, f.conf.Retry, func(attrs *storage.ObjectAttrs) error {
 			if len(attrs.Metadata) == 0 {
 				fmt.Printf("WARNING: no paths defined for object %s\n", attrs.Name)
-				continue
+				return nil
 			}
 			var paths map[string]int64
-			if err = json.Unmarshal([]byte(attrs.Metadata["paths"]), &paths); err != nil {
+			if err := json.Unmarshal([]byte(attrs.Metadata["paths"]), &paths); err != nil {
 				fmt.Printf("WARNING: unmarshaling paths in object %s: %s\n", attrs.Name, err)
-				continue
+				return nil
 			}
 			for path, unixtime := range paths {
 				f.addPath(attrs.Name, path, unixtime, uint64(attrs.Size))
 			}
-		}
+			return nil
+		})
 	}
 
 	// Build filesystem by parsing JSON list output.
 
-	var r io.Reader = os.Stdin
-	if fromfile != "-" {
-		inp, err := os.Open(fromfile)
-		if err != nil {
-			return nil, errors.Wrapf(err, "opening %s", fromfile)
-		}
-		defer inp.Close()
-		r = inp
-	}
-
-	dec := json.NewDecoder(r)
-	for dec.More() {
-		var l listType
-		if err := dec.Decode(&l); err != nil {
-			return nil, errors.Wrap(err, "JSON-decoding prescan input")
-		}
+	return readListFile(fromfile, func(l listType) error {
 		for path, timestamp := range l.Paths {
 			if err := f.addPath(l.Hash, path, timestamp.Unix(), uint64(l.Size)); err != nil {
-				return nil, errors.Wrap(err, "building prescan tree")
+				return errors.Wrapf(err, "adding %s", path)
 			}
 		}
+		return nil
+	})
+}
+
+// wait waits until the tree has been built
+// and reports any error from building it.
+// It returns right away if the tree comes from an index.
+func (f *FS) wait() error {
+	if f.built == nil {
+		return nil
 	}
+	<-f.built
+	return f.buildErr
+}
 
-	return f, nil
+// newRoot creates the root node of a tree.
+func (f *FS) newRoot() *FSNode {
+	return &FSNode{
+		fs:       f,
+		inode:    1,
+		children: make(map[string]*FSNode),
+	}
 }
 
-func (f *FS) addPath(hash, path string, unixtime int64, size uint64) error {
-	parent, basename, err := f.root.findParent(path, true)
+func (f *FS) addPath(hash, key string, unixtime int64, size uint64) error {
+	parent, basename, err := f.root.findParent(treePath(key), true)
 	if err != nil {
 		return err
 	}
+	if existing, ok := parent.children[basename]; ok && !existing.isDir() && existing.timestamp.Unix() > unixtime {
+		// Where more than one object has been saved at the same path,
+		// the most recently saved one is used.
+		return nil
+	}
 	node := &FSNode{
 		fs:        f,
-		inode:     f.allocateInode(),
+		inode:     f.inodeFor(joinTreePath(parent.path, basename), hash),
 		parent:    parent,
+		path:      joinTreePath(parent.path, basename),
 		hash:      hash,
+		key:       key,
 		timestamp: time.Unix(unixtime, 0),
 		size:      size,
 	}
 	parent.children[basename] = node
+	if host, _ := splitKey(key); host != "" {
+		f.hosts[host] = true
+	}
 	return nil
 }
 
-func (f *FS) allocateInode() uint64 {
+// inodeKey identifies a node for the purpose of giving it an inode number.
+type inodeKey struct {
+	path, hash string
+}
+
+// inodeFor returns the inode number for the node at path
+// (with the given hash, if it is a file).
+// It is derived from those,
+// so a given version of a file has the same inode number every time the file system is mounted.
+// In the unlikely event that this collides with the number of a different node,
+// the next free number is used instead.
+//
+// Since the path is part of it,
+// files with the same content at different paths have different inode numbers.
+// They are separate files, each with a link count of 1, not hard links to one another;
+// the hash xattr and the .duplicates directory (see hashviews.go) tell which ones share content.
+func (f *FS) inodeFor(path, hash string) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, path)
+	if hash != "" {
+		h.Write([]byte{0})
+		io.WriteString(h, hash)
+	}
+	var (
+		inode = h.Sum64()
+		key   = inodeKey{path: path, hash: hash}
+	)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for ; ; inode++ {
+		if inode <= 1 {
+			// 0 is not a valid inode number, and 1 is the root.
+			continue
+		}
+		if k, ok := f.inodes[inode]; !ok {
+			f.inodes[inode] = key
+			return inode
+		} else if k == key {
+			return inode
+		}
+	}
+}
+
+// pruneInodes forgets the inode numbers of nodes that are no longer in the tree,
+// so that f.inodes does not grow with every refresh.
+// The numbers of virtual nodes (see virtualInode) are kept.
+// The caller must hold f.treeMu.
+func (f *FS) pruneInodes() {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	result := f.nextInode
-	f.nextInode++
-	return result
+	inodes := make(map[uint64]inodeKey)
+	for inode, key := range f.inodes {
+		if strings.HasPrefix(key.path, "/") {
+			inodes[inode] = key
+		}
+	}
+
+	var walk func(*FSNode)
+	walk = func(n *FSNode) {
+		for _, child := range n.children {
+			inodes[child.inode] = inodeKey{path: child.path, hash: child.hash}
+			walk(child)
+		}
+	}
+	walk(f.root)
+
+	f.inodes = inodes
 }
 
 func (f *FS) Root() (fs.Node, error) {
-	return f.root, nil
+	return f.top, nil
+}
+
+// serveDir causes the subtree at dir to be served as the root of the file system.
+func (f *FS) serveDir(dir string) error {
+	node, err := f.root.findNode(dir, false)
+	if err != nil {
+		return errors.Wrapf(err, "finding %s", dir)
+	}
+	if !node.isDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f.top = node
+	return nil
 }
 
 var (
 	_ fs.Node               = &FSNode{}
 	_ fs.HandleReadAller    = &FSNode{}
 	_ fs.HandleReadDirAller = &FSNode{}
-	_ fs.HandleReader       = &FSNode{}
 )
 
 type FSNode struct {
 	fs     *FS
 	inode  uint64
 	parent *FSNode
+	path   string // the path of this node in the tree, without a leading slash
 
 	// If this is a dir:
-	children map[string]*FSNode
+	children   map[string]*FSNode
+	loaded     bool   // whether children has been populated from the index (see load)
+	nlink      uint32 // the link count (see dirStat)
+	statLoaded bool   // whether timestamp and nlink have been set from the index (see dirStat)
 
 	// If this is a file:
-	hash      string // hash != "" means this is a file
-	timestamp time.Time
+	hash      string    // the name of its object; "" if it has not been saved (see stage)
+	key       string    // the key under which it is recorded in the object's paths metadata, if known
+	timestamp time.Time // for a dir, the latest timestamp under it (see dirStat)
 	size      uint64
+
+	// In a writable file system (see rw.go),
+	// these are protected by fs.treeMu, as are the fields above.
+	stage *stagedFile // if non-nil, the file's content is here rather than in its object
+	opens int         // the number of open handles to the file
+
+	virtual bool // whether this is a file in .by-hash, which is never writable (see hashviews.go)
 }
 
+// isDir tells whether n is a directory.
+// A directory's children map is never nil,
+// even while a file being written has no hash.
 func (n *FSNode) isDir() bool {
-	return n.hash == ""
+	return n.children != nil
 }
 
 func (n *FSNode) Attr(ctx context.Context, a *fuse.Attr) error {
-	a.Inode = n.inode
-	a.Size = n.size
-	a.Mtime = n.timestamp
-
-	if n.hash == "" {
-		// dir
-		a.Mode = os.ModeDir | 0555
+	if n.isDir() {
+		mtime, nlink, err := n.dirStat(ctx)
+		if err != nil {
+			return err
+		}
+		a.Mtime = mtime
+		a.Nlink = nlink
+		n.fs.setOwner(a, os.ModeDir|0777)
+	} else if n.virtual {
+		a.Nlink = 1
+		n.fs.setOwner(a, 0444)
 	} else {
-		// file
-		a.Mode = 0444
+		a.Nlink = 1
+		n.fs.setOwner(a, 0666)
+	}
+
+	n.fs.treeMu.RLock()
+	defer n.fs.treeMu.RUnlock()
+
+	a.Inode = n.inode
+	if !n.isDir() {
+		a.Mtime = n.timestamp
+		a.Size = n.size
+		if n.stage != nil {
+			n.stage.attr(a)
+		}
 	}
 
 	return nil
 }
 
 func (n *FSNode) Lookup(_ context.Context, name string) (fs.Node, error) {
+	if n.isVirtual(name) {
+		return n.fs.virtualDir(name), nil
+	}
 	return n.findNode(name, false)
 }
 
 func (n *FSNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	return n.dirents(), nil
+	return n.dirents()
 }
 
-func (n *FSNode) dirents() []fuse.Dirent {
+func (n *FSNode) dirents() ([]fuse.Dirent, error) {
+	if err := n.load(); err != nil {
+		return nil, err
+	}
+
+	n.fs.treeMu.RLock()
+	defer n.fs.treeMu.RUnlock()
+
 	var result []fuse.Dirent
+	if n == n.fs.top {
+		result = n.fs.virtualDirents()
+	}
 	for name, child := range n.children {
+		if n.isVirtual(name) {
+			// Hidden by a virtual directory.
+			continue
+		}
 		typ := fuse.DT_File
-		if child.hash == "" {
+		if child.isDir() {
 			typ = fuse.DT_Dir
 		}
 		result = append(result, fuse.Dirent{
@@ -259,55 +528,52 @@ func (n *FSNode) dirents() []fuse.Dirent {
 			Name:  name,
 		})
 	}
-	return result
-}
 
-func (n *FSNode) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
-	if req.Dir {
-		var (
-			dirents = n.dirents()
-			result  []byte
-		)
-		for _, dirent := range dirents {
-			result = fuse.AppendDirent(result, dirent)
-		}
-		resp.Data = result
-		return nil
-	}
+	// Sorting makes listings the same from one call to the next.
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
 
-	start := time.Now()
-	defer func() {
-		if err != nil {
-			log.Printf("Read %s: error: %s", n.hash, err)
-		} else {
-			log.Printf("Read %s: %d bytes in %s", n.hash, len(resp.Data), time.Since(start))
-		}
-	}()
+	return result, nil
+}
 
-	obj := n.fs.bucket.Object(n.hash)
-	r, err := gcsobj.NewReader(ctx, obj)
-	if err != nil {
-		return err
+// readRange reads size bytes of the file at n, starting at offset,
+// with a request for just that range.
+// The result is short only if it reaches the end of the file.
+func (n *FSNode) readRange(ctx context.Context, offset int64, size int) ([]byte, error) {
+	if end := int64(n.size); offset+int64(size) > end {
+		size = int(end - offset)
+	}
+	if size <= 0 {
+		return nil, nil
 	}
-	defer r.Close()
 
-	if req.Offset > 0 {
-		if _, err = r.Seek(req.Offset, io.SeekStart); err != nil {
+	var (
+		buf    = make([]byte, size)
+		nbytes int
+	)
+
+	// On retry, reading resumes at the offset where the failure happened.
+	err := withRetries(n.fs.conf.Retry.newBackoff(ctx), func() error {
+		r, err := n.fs.objects.NewRangeReader(ctx, n.hash, offset+int64(nbytes), int64(size-nbytes))
+		if err != nil {
 			return err
 		}
-	}
-
-	buf := make([]byte, req.Size)
-	nbytes, err := r.Read(buf)
-	resp.Data = buf[:nbytes]
+		defer r.Close()
 
-	if errors.Is(err, io.EOF) {
-		// Not sure this is right.
-		err = nil
-	}
-	return err
+		nread, err := io.ReadFull(r, buf[nbytes:])
+		nbytes += nread
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// The object is shorter than its recorded size.
+			err = nil
+		}
+		return err
+	})
+	return buf[:nbytes], err
 }
 
+// ReadAll reads the whole file at n.
+// Files are read this way when readahead is disabled (see Open):
+// the FUSE server serves each read of the open file from the result.
+// Directories are read with ReadDirAll instead.
 func (n *FSNode) ReadAll(ctx context.Context) (res []byte, err error) {
 	start := time.Now()
 	defer func() {
@@ -318,46 +584,43 @@ func (n *FSNode) ReadAll(ctx context.Context) (res []byte, err error) {
 		}
 	}()
 
+	if n.fs.cache != nil {
+		return n.readCached(ctx, 0, int64(n.size))
+	}
+
 	if large := n.fs.conf.Large; large > 0 && n.size > large {
 		return n.readAllLarge(ctx)
 	}
 
-	obj := n.fs.bucket.Object(n.hash)
-	r, err := obj.NewReader(ctx)
-	if err != nil {
-		return nil, err
-	}
-	defer r.Close()
-	return io.ReadAll(r)
+	return n.readRange(ctx, 0, int(n.size))
 }
 
+// readAllLarge reads the whole file at n
+// with a ranged request for each chunk of it.
 func (n *FSNode) readAllLarge(ctx context.Context) ([]byte, error) {
-	obj := n.fs.bucket.Object(n.hash)
-	r, err := gcsobj.NewReader(ctx, obj)
-	if err != nil {
-		return nil, err
-	}
-	defer r.Close()
-
 	var (
-		buf    = make([]byte, n.size)
-		offset uint64
+		buf   = make([]byte, 0, n.size)
+		chunk = int64(n.fs.conf.Chunk)
 	)
-
-	for {
-		lim := offset + n.fs.conf.Chunk
-		if buflen := uint64(len(buf)); lim > buflen {
-			lim = buflen
+	if chunk == 0 {
+		chunk = int64(n.size)
+	}
+	for int64(len(buf)) < int64(n.size) {
+		size := chunk
+		if rest := int64(n.size) - int64(len(buf)); rest < size {
+			size = rest
 		}
-		nbytes, err := r.Read(buf[offset:lim])
-		offset += uint64(nbytes)
-		if err != nil || offset == uint64(len(buf)) {
-			if errors.Is(err, io.EOF) {
-				err = nil
-			}
-			return buf[:offset], err
+		data, err := n.readRange(ctx, int64(len(buf)), int(size))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			// The object is shorter than its recorded size.
+			break
 		}
+		buf = append(buf, data...)
 	}
+	return buf, nil
 }
 
 func (n *FSNode) findNode(name string, create bool) (*FSNode, error) {
@@ -365,7 +628,10 @@ func (n *FSNode) findNode(name string, create bool) (*FSNode, error) {
 	if err != nil {
 		return nil, err
 	}
-	if found, ok := parent.children[basename]; ok {
+	if err := parent.load(); err != nil {
+		return nil, err
+	}
+	if found, ok := parent.child(basename); ok {
 		return found, nil
 	}
 	return nil, syscall.ENOENT
@@ -379,15 +645,23 @@ func (n *FSNode) findParent(name string, create bool) (*FSNode, string, error) {
 	parts := strings.Split(name, "/")
 	parent := n
 	for i := 0; i < len(parts)-1; i++ {
-		part := parts[i]
-		child, ok := parent.children[part]
-		if !ok && create {
-			child = &FSNode{
-				fs:       n.fs,
-				inode:    n.fs.allocateInode(),
-				parent:   parent,
-				children: make(map[string]*FSNode),
+		var (
+			part  = parts[i]
+			child *FSNode
+			ok    bool
+		)
+		if create {
+			// Nodes are created only while building the tree,
+			// which must not wait for itself.
+			child, ok = parent.children[part]
+		} else {
+			if err := parent.load(); err != nil {
+				return nil, "", err
 			}
+			child, ok = parent.child(part)
+		}
+		if !ok && create {
+			child = parent.newDir(part)
 			parent.children[part] = child
 			parent = child
 			continue
@@ -395,10 +669,54 @@ func (n *FSNode) findParent(name string, create bool) (*FSNode, string, error) {
 		if !ok {
 			return nil, "", syscall.ENOENT
 		}
-		if child.hash != "" {
+		if !child.isDir() {
 			return nil, "", syscall.ENOTDIR
 		}
 		parent = child
 	}
 	return parent, parts[len(parts)-1], nil
 }
+
+// child returns the child of the directory node n with the given name.
+// The caller must already have called load.
+func (n *FSNode) child(name string) (*FSNode, bool) {
+	n.fs.treeMu.RLock()
+	defer n.fs.treeMu.RUnlock()
+
+	child, ok := n.children[name]
+	return child, ok
+}
+
+// newDir creates a new directory node that is a child of n.
+// The caller must add it to n.children.
+func (n *FSNode) newDir(name string) *FSNode {
+	return &FSNode{
+		fs:       n.fs,
+		inode:    n.fs.inodeFor(joinTreePath(n.path, name), ""),
+		parent:   n,
+		path:     joinTreePath(n.path, name),
+		children: make(map[string]*FSNode),
+	}
+}
+
+// load populates the children of the directory node n
+// if the file system is backed by an index and that hasn't happened yet.
+// Otherwise it waits for the tree to be built.
+// It must be called before n.children is used.
+func (n *FSNode) load() error {
+	if n.fs.idx == nil {
+		return n.fs.wait()
+	}
+
+	n.fs.treeMu.Lock()
+	defer n.fs.treeMu.Unlock()
+
+	if n.loaded {
+		return nil
+	}
+	if err := n.loadFromIndex(context.Background(), n.fs.idx); err != nil {
+		return err
+	}
+	n.loaded = true
+	return nil
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/seaweedfs/fuse"
+	"google.golang.org/api/googleapi"
+)
+
+// fakeObjects is an objectReader and objectWriter holding objects in memory.
+// Its readers return data in pieces of random sizes,
+// and if flaky is set,
+// some of them fail partway through with a retryable error.
+type fakeObjects struct {
+	objects map[string][]byte
+	flaky   bool
+
+	// If non-nil, opening a reader waits until this is closed
+	// (or the reader's context is canceled).
+	hold chan struct{}
+
+	mu      sync.Mutex // protects rnd, opens, writes, and holding, and objects while writers are in use
+	rnd     *rand.Rand
+	opens   int
+	writes  int
+	holding int // the number of readers waiting for hold
+}
+
+func newFakeObjects(flaky bool, objects map[string][]byte) *fakeObjects {
+	return &fakeObjects{
+		objects: objects,
+		flaky:   flaky,
+		rnd:     rand.New(rand.NewSource(1)),
+	}
+}
+
+func (f *fakeObjects) NewRangeReader(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	if f.hold != nil {
+		f.mu.Lock()
+		f.holding++
+		f.mu.Unlock()
+
+		select {
+		case <-f.hold:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	f.mu.Lock()
+	data, ok := f.objects[name]
+	f.mu.Unlock()
+	if !ok {
+		return nil, errors.Errorf("no object %s", name)
+	}
+	if offset < 0 || offset > int64(len(data)) {
+		return nil, errors.Errorf("offset %d out of range for %s (size %d)", offset, name, len(data))
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.opens++
+	r := &fakeReader{f: f, data: data, failAt: -1}
+	if f.flaky && len(data) > 0 && f.rnd.Intn(3) == 0 {
+		r.failAt = f.rnd.Intn(len(data))
+	}
+	return r, nil
+}
+
+func (f *fakeObjects) NewWriter(ctx context.Context, name string, crc uint32, sendCRC bool) uploadWriter {
+	return &fakeWriter{f: f, name: name, crc: crc, sendCRC: sendCRC}
+}
+
+func (f *fakeObjects) intn(n int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rnd.Intn(n)
+}
+
+type fakeReader struct {
+	f      *fakeObjects
+	data   []byte
+	pos    int
+	failAt int // the position at which reading fails, or -1
+}
+
+func (r *fakeReader) Read(buf []byte) (int, error) {
+	if r.failAt >= 0 && r.pos >= r.failAt {
+		return 0, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	}
+	if r.pos >= len(r.data) {
+		return 0, io.EOF
+	}
+	end := len(r.data)
+	if r.failAt >= 0 {
+		end = r.failAt
+	}
+	if n := r.pos + 1 + r.f.intn(8192); n < end {
+		end = n
+	}
+	n := copy(buf, r.data[r.pos:end])
+	r.pos += n
+	return n, nil
+}
+
+func (r *fakeReader) Close() error {
+	return nil
+}
+
+// fakeWriter creates an object in a fakeObjects when it is closed.
+// Like GCS, it rejects content that doesn't match a CRC32C it was sent.
+type fakeWriter struct {
+	f       *fakeObjects
+	name    string
+	crc     uint32
+	sendCRC bool
+	buf     bytes.Buffer
+}
+
+func (w *fakeWriter) Write(data []byte) (int, error) {
+	return w.buf.Write(data)
+}
+
+func (w *fakeWriter) Close() error {
+	w.f.mu.Lock()
+	defer w.f.mu.Unlock()
+
+	w.f.writes++
+	if got := crc32.Checksum(w.buf.Bytes(), crc32cTable); w.sendCRC && got != w.crc {
+		return &googleapi.Error{Code: 400, Message: fmt.Sprintf("Provided CRC32C %08x doesn't match calculated CRC32C %08x", w.crc, got)}
+	}
+	if w.f.objects == nil {
+		w.f.objects = make(map[string][]byte)
+	}
+	w.f.objects[w.name] = w.buf.Bytes()
+	return nil
+}
+
+func (w *fakeWriter) CRC32C() uint32 {
+	return crc32.Checksum(w.buf.Bytes(), crc32cTable)
+}
+
+// newTestFS produces a file system reading objects from fake,
+// and a node for each of them.
+func newTestFS(fake *fakeObjects) (*FS, map[string]*FSNode) {
+	f := &FS{
+		objects: fake,
+		inodes:  make(map[uint64]inodeKey),
+		conf: fsConf{
+			Retry: retryConf{
+				Retries: 10,
+				Initial: time.Microsecond,
+				Max:     time.Millisecond,
+			},
+		},
+	}
+	f.root = f.newRoot()
+	f.top = f.root
+
+	nodes := make(map[string]*FSNode)
+	for name, data := range fake.objects {
+		nodes[name] = &FSNode{
+			fs:     f,
+			parent: f.root,
+			path:   name,
+			hash:   name,
+			size:   uint64(len(data)),
+		}
+	}
+	return f, nodes
+}
+
+func randomBytes(rnd *rand.Rand, n int) []byte {
+	buf := make([]byte, n)
+	rnd.Read(buf)
+	return buf
+}
+
+// wantRange is the expected result of reading size bytes of data at offset.
+func wantRange(data []byte, offset int64, size int) []byte {
+	if offset >= int64(len(data)) {
+		return nil
+	}
+	end := offset + int64(size)
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	return data[offset:end]
+}
+
+func TestReadRange(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		rnd  = rand.New(rand.NewSource(2))
+		data = randomBytes(rnd, 100003)
+		fake = newFakeObjects(true, map[string][]byte{"obj": data})
+	)
+	_, nodes := newTestFS(fake)
+	n := nodes["obj"]
+
+	check := func(offset int64, size int) {
+		t.Helper()
+
+		got, err := n.readRange(ctx, offset, size)
+		if err != nil {
+			t.Fatalf("reading %d bytes at %d: %s", size, offset, err)
+		}
+		if want := wantRange(data, offset, size); !bytes.Equal(got, want) {
+			t.Fatalf("reading %d bytes at %d: got %d bytes, want %d (content equal: %v)", size, offset, len(got), len(want), bytes.Equal(got, want))
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		check(rnd.Int63n(int64(len(data))+100), rnd.Intn(30000))
+	}
+
+	// The edges.
+	check(0, len(data))
+	check(0, len(data)+1)
+	check(int64(len(data))-1, 1)
+	check(int64(len(data))-1, 100)
+	check(int64(len(data)), 100)
+	check(int64(len(data))+1, 100)
+	check(0, 0)
+}
+
+func TestReadAll(t *testing.T) {
+	ctx := context.Background()
+	rnd := rand.New(rand.NewSource(9))
+
+	cases := []struct {
+		name         string
+		size         int
+		large, chunk uint64
+		cache        bool
+	}{
+		{name: "small", size: 100003},
+		{name: "empty", size: 0},
+		{name: "large", size: 100003, large: 50000, chunk: 30000},
+		{name: "large_exact", size: 90000, large: 50000, chunk: 30000},
+		{name: "cached", size: 100003, cache: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var (
+				data = randomBytes(rnd, c.size)
+				fake = newFakeObjects(true, map[string][]byte{"obj": data})
+			)
+			f, nodes := newTestFS(fake)
+			f.conf.Large = c.large
+			f.conf.Chunk = c.chunk
+			if c.cache {
+				var err error
+				f.cache, err = newBlockCache(cacheConf{Dir: t.TempDir(), Block: 4096})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := nodes["obj"].ReadAll(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("got %d bytes, want %d (content equal: %v)", len(got), len(data), bytes.Equal(got, data))
+			}
+			if c.chunk > 0 {
+				if want := (c.size + int(c.chunk) - 1) / int(c.chunk); fake.opens < want {
+					t.Errorf("got %d requests, want at least %d", fake.opens, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadDirAll(t *testing.T) {
+	const (
+		nfiles = 5000
+		ndirs  = 100
+	)
+
+	ctx := context.Background()
+	t0 := time.Unix(1700000000, 0)
+
+	// entries produces the list entries for the big directory,
+	// plus extra more files.
+	entries := func(extra int) []listType {
+		var result []listType
+		for i := 0; i < nfiles+extra; i++ {
+			result = append(result, listType{
+				Hash:  fmt.Sprintf("sha256-%064x", i),
+				Size:  1,
+				Paths: map[string]time.Time{fmt.Sprintf("host:/big/file-%06d", i): t0},
+			})
+		}
+		for i := 0; i < ndirs; i++ {
+			result = append(result, listType{
+				Hash:  fmt.Sprintf("sha256-%064x", nfiles+extra+i),
+				Size:  1,
+				Paths: map[string]time.Time{fmt.Sprintf("host:/big/dir-%03d/file", i): t0},
+			})
+		}
+		return result
+	}
+
+	writers := map[string]func(filename string, entries []listType) error{
+		"list": func(filename string, entries []listType) error {
+			return writeListFile(filename, func(write func(listType) error) error {
+				for _, l := range entries {
+					if err := write(l); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+		"index": func(filename string, entries []listType) error {
+			return buildIndex(ctx, filename, func(add func(listType) error) error {
+				for _, l := range entries {
+					if err := add(l); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+	}
+
+	for kind, write := range writers {
+		t.Run(kind, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "list")
+			if err := write(filename, entries(0)); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := newFS(ctx, nil, retryConf{}, filename, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.wait(); err != nil {
+				t.Fatal(err)
+			}
+
+			readDir := func() []fuse.Dirent {
+				t.Helper()
+				dir, err := f.root.findNode("host/big", false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dirents, err := dir.ReadDirAll(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return dirents
+			}
+
+			// Each open handle on the directory gets its own listing.
+			dirents := readDir()
+			if again := readDir(); !reflect.DeepEqual(again, dirents) {
+				t.Fatal("listing changed from one handle to the next")
+			}
+
+			if len(dirents) != nfiles+ndirs {
+				t.Fatalf("got %d entries, want %d", len(dirents), nfiles+ndirs)
+			}
+			var data []byte
+			for _, dirent := range dirents {
+				data = fuse.AppendDirent(data, dirent)
+			}
+			if len(data) <= 128<<10 {
+				t.Fatalf("listing is only %d bytes, which fits in one page", len(data))
+			}
+
+			inodes := make(map[uint64]string)
+			for i, dirent := range dirents {
+				if i > 0 && dirents[i-1].Name >= dirent.Name {
+					t.Fatalf("entry %d (%s) is out of order or duplicated after %s", i, dirent.Name, dirents[i-1].Name)
+				}
+				if other, ok := inodes[dirent.Inode]; ok {
+					t.Fatalf("%s and %s have the same inode number %d", other, dirent.Name, dirent.Inode)
+				}
+				inodes[dirent.Inode] = dirent.Name
+			}
+			for i := 0; i < ndirs; i++ {
+				if name := fmt.Sprintf("dir-%03d", i); dirents[i].Name != name || dirents[i].Type != fuse.DT_Dir {
+					t.Errorf("entry %d: got %s (type %v), want directory %s", i, dirents[i].Name, dirents[i].Type, name)
+				}
+			}
+			for i := 0; i < nfiles; i++ {
+				if name := fmt.Sprintf("file-%06d", i); dirents[ndirs+i].Name != name || dirents[ndirs+i].Type != fuse.DT_File {
+					t.Fatalf("entry %d: got %s (type %v), want file %s", ndirs+i, dirents[ndirs+i].Name, dirents[ndirs+i].Type, name)
+				}
+			}
+
+			// After a refresh that adds a file,
+			// everything else is listed as before.
+			if err := write(filename, entries(1)); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.refresh(ctx); err != nil {
+				t.Fatal(err)
+			}
+			refreshed := readDir()
+			added := fmt.Sprintf("file-%06d", nfiles)
+			if len(refreshed) != len(dirents)+1 || refreshed[len(refreshed)-1].Name != added {
+				t.Fatalf("after refresh, got %d entries ending with %s, want %d ending with %s", len(refreshed), refreshed[len(refreshed)-1].Name, len(dirents)+1, added)
+			}
+			if !reflect.DeepEqual(refreshed[:len(dirents)], dirents) {
+				t.Error("after refresh, existing entries changed")
+			}
+		})
+	}
+}
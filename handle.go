@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/seaweedfs/fuse"
+	"github.com/seaweedfs/fuse/fs"
+)
+
+const (
+	defaultReadahead = 8 << 20
+
+	// prefetchChunkSize is the size of the pieces in which a prefetcher reads ahead.
+	prefetchChunkSize = 256 << 10
+)
+
+var (
+	_ fs.NodeOpener     = &FSNode{}
+	_ fs.HandleReader   = &fileHandle{}
+	_ fs.HandleReleaser = &fileHandle{}
+)
+
+// Open returns a handle for reading the file at n.
+// Directories are their own handles,
+// as are files when readahead is disabled
+// (in which case each file is read in full on first access, see ReadAll),
+// except in a writable file system (see openRW).
+func (n *FSNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if n.isDir() {
+		return n, nil
+	}
+	if n.fs.rw != nil {
+		return n.openRW(ctx, req)
+	}
+	if n.fs.conf.Readahead == 0 {
+		return n, nil
+	}
+	return &fileHandle{n: n, cached: -1}, nil
+}
+
+// fileHandle reads a file for one open file descriptor.
+// When the file is read sequentially,
+// it keeps a streaming reader open
+// and reads ahead of the requests it gets.
+// Other reads are done with ranged requests.
+type fileHandle struct {
+	n *FSNode
+
+	mu     sync.Mutex // protects the fields below
+	next   int64      // the offset just past the previous read
+	seq    int        // the number of consecutive sequential reads
+	stream *prefetcher
+	cached int64 // the block cache holds (or is fetching) blocks up to this one
+}
+
+func (h *fileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	n := h.n
+
+	start := time.Now()
+	defer func() {
+		if err != nil {
+			log.Printf("Read %s: error: %s", n.hash, err)
+		} else {
+			log.Printf("Read %s: %d bytes at %d in %s", n.hash, len(resp.Data), req.Offset, time.Since(start))
+		}
+	}()
+
+	if req.Offset >= int64(n.size) {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if req.Offset == h.next {
+		h.seq++
+	} else {
+		h.seq = 0
+		h.cached = -1
+	}
+	defer func() {
+		if err == nil {
+			h.next = req.Offset + int64(len(resp.Data))
+		}
+	}()
+
+	if n.fs.cache != nil {
+		if h.seq > 0 {
+			h.prefetchBlocks(req.Offset + int64(req.Size))
+		}
+		resp.Data, err = n.readCached(ctx, req.Offset, int64(req.Size))
+		return err
+	}
+
+	if h.seq == 0 {
+		// A random seek.
+		h.stopStream()
+		resp.Data, err = n.readRange(ctx, req.Offset, req.Size)
+		return err
+	}
+
+	if h.stream == nil || h.stream.pos != req.Offset {
+		h.stopStream()
+		h.stream = n.newPrefetcher(req.Offset, int64(n.fs.conf.Readahead))
+	}
+	data, err := h.stream.read(ctx, req.Size)
+	if err != nil {
+		log.Printf("Streaming %s: %s (falling back to ranged read)", n.hash, err)
+		h.stopStream()
+		resp.Data, err = n.readRange(ctx, req.Offset, req.Size)
+		return err
+	}
+	resp.Data = data
+	return nil
+}
+
+// prefetchBlocks starts fetching into the block cache, in the background,
+// the blocks of the file within the readahead window past offset.
+// The caller must hold h.mu.
+func (h *fileHandle) prefetchBlocks(offset int64) {
+	n := h.n
+	if n.size == 0 {
+		return
+	}
+
+	var (
+		bs   = n.fs.cache.blockSize
+		last = (offset + int64(n.fs.conf.Readahead) - 1) / bs
+	)
+	if maxBlock := (int64(n.size) - 1) / bs; last > maxBlock {
+		last = maxBlock
+	}
+	first := offset / bs
+	if first <= h.cached {
+		first = h.cached + 1
+	}
+	if first > last {
+		return
+	}
+	h.cached = last
+
+	go func() {
+		for i := first; i <= last; i++ {
+			if _, err := n.readBlock(context.Background(), i); err != nil {
+				log.Printf("Prefetching %s: %s", n.hash, err)
+				return
+			}
+		}
+	}()
+}
+
+func (h *fileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.stopStream()
+	if h.n.fs.rw != nil {
+		return h.n.release(ctx)
+	}
+	return nil
+}
+
+// stopStream discards the handle's prefetcher, if any.
+// The caller must hold h.mu.
+func (h *fileHandle) stopStream() {
+	if h.stream != nil {
+		h.stream.stop()
+		h.stream = nil
+	}
+}
+
+// prefetcher reads a file sequentially in the background,
+// staying up to a readahead window ahead of the reads done with it.
+type prefetcher struct {
+	pos    int64 // the offset of the next byte to be returned by read
+	buf    []byte
+	chunks chan prefetchChunk
+	cancel context.CancelFunc
+}
+
+type prefetchChunk struct {
+	data []byte
+	err  error
+}
+
+func (n *FSNode) newPrefetcher(offset, window int64) *prefetcher {
+	nchunks := window / prefetchChunkSize
+	if nchunks < 1 {
+		nchunks = 1
+	}
+
+	// The prefetcher outlives the request that creates it,
+	// so it does not use the request's context.
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p := &prefetcher{
+		pos:    offset,
+		chunks: make(chan prefetchChunk, nchunks),
+		cancel: cancel,
+	}
+
+	go func() {
+		defer close(p.chunks)
+
+		send := func(c prefetchChunk) bool {
+			select {
+			case p.chunks <- c:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		r, err := n.fs.objects.NewRangeReader(ctx, n.hash, offset, -1)
+		if err != nil {
+			send(prefetchChunk{err: errors.Wrapf(err, "opening %s at %d", n.hash, offset)})
+			return
+		}
+		defer r.Close()
+
+		for {
+			buf := make([]byte, prefetchChunkSize)
+			nbytes, err := io.ReadFull(r, buf)
+			if nbytes > 0 && !send(prefetchChunk{data: buf[:nbytes]}) {
+				return
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return
+			}
+			if err != nil {
+				send(prefetchChunk{err: errors.Wrapf(err, "reading %s", n.hash)})
+				return
+			}
+		}
+	}()
+
+	return p
+}
+
+// read returns the next size bytes of the file.
+// The result is short only at the end of the file.
+func (p *prefetcher) read(ctx context.Context, size int) ([]byte, error) {
+	result := make([]byte, 0, size)
+	for len(result) < size {
+		if len(p.buf) == 0 {
+			select {
+			case c, ok := <-p.chunks:
+				if !ok {
+					// End of file.
+					p.pos += int64(len(result))
+					return result, nil
+				}
+				if c.err != nil {
+					return nil, c.err
+				}
+				p.buf = c.data
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		nbytes := copy(result[len(result):size], p.buf)
+		result = result[:len(result)+nbytes]
+		p.buf = p.buf[nbytes:]
+	}
+	p.pos += int64(len(result))
+	return result, nil
+}
+
+func (p *prefetcher) stop() {
+	p.cancel()
+}
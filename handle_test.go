@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/seaweedfs/fuse"
+)
+
+func TestPrefetcher(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		rnd  = rand.New(rand.NewSource(3))
+		size = 3*prefetchChunkSize + 12345
+		data = randomBytes(rnd, size)
+		fake = newFakeObjects(false, map[string][]byte{"obj": data})
+	)
+	_, nodes := newTestFS(fake)
+	n := nodes["obj"]
+
+	for _, offset := range []int64{0, 1, prefetchChunkSize - 1, prefetchChunkSize, int64(size) - 100, int64(size) - 1, int64(size)} {
+		p := n.newPrefetcher(offset, 2*prefetchChunkSize)
+
+		var got []byte
+		for {
+			reqSize := 1 + rnd.Intn(3*prefetchChunkSize/2)
+			chunk, err := p.read(ctx, reqSize)
+			if err != nil {
+				t.Fatalf("offset %d: reading %d bytes at %d: %s", offset, reqSize, p.pos, err)
+			}
+			if len(chunk) > reqSize {
+				t.Fatalf("offset %d: got %d bytes, want at most %d", offset, len(chunk), reqSize)
+			}
+			got = append(got, chunk...)
+			if len(chunk) < reqSize {
+				// A short read must be at the end of the file.
+				if end := offset + int64(len(got)); end != int64(size) {
+					t.Fatalf("offset %d: short read (%d of %d bytes) ending at %d, before the end of the file at %d", offset, len(chunk), reqSize, end, size)
+				}
+				break
+			}
+		}
+		if !bytes.Equal(got, data[offset:]) {
+			t.Errorf("offset %d: got %d bytes, want %d (content equal: %v)", offset, len(got), size-int(offset), bytes.Equal(got, data[offset:]))
+		}
+
+		// Reading past the end produces nothing, and no error.
+		chunk, err := p.read(ctx, 100)
+		if err != nil {
+			t.Errorf("offset %d: reading past the end: %s", offset, err)
+		}
+		if len(chunk) != 0 {
+			t.Errorf("offset %d: reading past the end: got %d bytes, want 0", offset, len(chunk))
+		}
+		if p.pos != int64(size) {
+			t.Errorf("offset %d: got final position %d, want %d", offset, p.pos, size)
+		}
+
+		p.stop()
+	}
+}
+
+func TestFileHandleRead(t *testing.T) {
+	for _, cached := range []bool{false, true} {
+		name := "uncached"
+		if cached {
+			name = "cached"
+		}
+		t.Run(name, func(t *testing.T) {
+			var (
+				ctx  = context.Background()
+				rnd  = rand.New(rand.NewSource(4))
+				size = 5*prefetchChunkSize + 777
+				data = randomBytes(rnd, size)
+				fake = newFakeObjects(true, map[string][]byte{"obj": data})
+			)
+			f, nodes := newTestFS(fake)
+			f.conf.Readahead = 2 * prefetchChunkSize
+			if cached {
+				var err error
+				f.cache, err = newBlockCache(cacheConf{Dir: t.TempDir(), Size: 1 << 20, Block: 100000})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			h := &fileHandle{n: nodes["obj"], cached: -1}
+			defer h.Release(ctx, &fuse.ReleaseRequest{})
+
+			var offset int64
+			for i := 0; i < 300; i++ {
+				if rnd.Intn(10) == 0 {
+					// A random seek, sometimes at or past the end.
+					offset = rnd.Int63n(int64(size) + 1000)
+				}
+				reqSize := 1 + rnd.Intn(128<<10)
+
+				req := &fuse.ReadRequest{Offset: offset, Size: reqSize}
+				resp := &fuse.ReadResponse{}
+				if err := h.Read(ctx, req, resp); err != nil {
+					t.Fatalf("reading %d bytes at %d: %s", reqSize, offset, err)
+				}
+				if want := wantRange(data, offset, reqSize); !bytes.Equal(resp.Data, want) {
+					t.Fatalf("reading %d bytes at %d: got %d bytes, want %d (content equal: %v)", reqSize, offset, len(resp.Data), len(want), bytes.Equal(resp.Data, want))
+				}
+
+				offset += int64(len(resp.Data))
+				if offset >= int64(size) {
+					offset = 0
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/bobg/go-generics/v2/maps"
+	"github.com/pkg/errors"
+	"github.com/seaweedfs/fuse"
+	"github.com/seaweedfs/fuse/fs"
+)
+
+// The top of the file system has two virtual directories
+// giving content-addressed views of the bucket:
+// .by-hash, in which every object can be looked up by name,
+// and .duplicates, which has a subdirectory for each hash shared by more than one file,
+// containing symlinks to those files.
+// Neither can be written to, even in a writable file system.
+const (
+	byHashName     = ".by-hash"
+	duplicatesName = ".duplicates"
+
+	// hashXattr is the extended attribute giving the name of a file's object.
+	hashXattr = "user.gcsbackup.hash"
+)
+
+var (
+	_ fs.NodeGetxattrer     = &FSNode{}
+	_ fs.NodeListxattrer    = &FSNode{}
+	_ fs.NodeStringLookuper = &byHashDir{}
+	_ fs.HandleReadDirAller = &byHashDir{}
+	_ fs.NodeStringLookuper = &dupsDir{}
+	_ fs.HandleReadDirAller = &dupsDir{}
+	_ fs.NodeStringLookuper = &dupGroup{}
+	_ fs.HandleReadDirAller = &dupGroup{}
+	_ fs.NodeReadlinker     = &dupLink{}
+)
+
+// virtualInode gives the inode number for a virtual node.
+// Tree paths never begin with a slash,
+// so these cannot be confused with the inode numbers of real nodes.
+func (f *FS) virtualInode(path, hash string) uint64 {
+	return f.inodeFor("/"+path, hash)
+}
+
+// virtualDir returns the virtual directory with the given name at the top of the file system,
+// or nil if there is none.
+func (f *FS) virtualDir(name string) fs.Node {
+	switch name {
+	case byHashName:
+		return f.byHash
+	case duplicatesName:
+		return &dupsDir{fs: f}
+	}
+	return nil
+}
+
+// isVirtual tells whether name is the name of a virtual directory in the directory n.
+func (n *FSNode) isVirtual(name string) bool {
+	return n == n.fs.top && n.fs.virtualDir(name) != nil
+}
+
+// virtualDirents are the directory entries added at the top of the file system.
+func (f *FS) virtualDirents() []fuse.Dirent {
+	return []fuse.Dirent{
+		{Inode: f.virtualInode(byHashName, ""), Type: fuse.DT_Dir, Name: byHashName},
+		{Inode: f.virtualInode(duplicatesName, ""), Type: fuse.DT_Dir, Name: duplicatesName},
+	}
+}
+
+func (n *FSNode) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if req.Name != hashXattr {
+		return fuse.ErrNoXattr
+	}
+
+	n.fs.treeMu.RLock()
+	defer n.fs.treeMu.RUnlock()
+
+	if !n.hasObject() {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = []byte(n.hash)
+	return nil
+}
+
+func (n *FSNode) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	n.fs.treeMu.RLock()
+	defer n.fs.treeMu.RUnlock()
+
+	if n.hasObject() {
+		resp.Append(hashXattr)
+	}
+	return nil
+}
+
+// hasObject tells whether n is a file whose content is that of its object
+// (and not a directory, or a file being written).
+// The caller must hold n.fs.treeMu.
+func (n *FSNode) hasObject() bool {
+	return !n.isDir() && n.hash != "" && n.stage == nil
+}
+
+// hashIndex returns the files in the served tree, grouped by hash.
+// It is computed when first needed and again after each refresh.
+// For a tree loaded from an index, this loads every directory.
+func (f *FS) hashIndex() (map[string][]*FSNode, error) {
+	f.hashMu.Lock()
+	defer f.hashMu.Unlock()
+
+	if f.hashes != nil {
+		return f.hashes, nil
+	}
+
+	hashes := make(map[string][]*FSNode)
+	err := f.top.walkFiles(func(n *FSNode) {
+		if n.hash != "" {
+			hashes[n.hash] = append(hashes[n.hash], n)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, nodes := range hashes {
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].path < nodes[j].path })
+	}
+	f.hashes = hashes
+	return hashes, nil
+}
+
+// clearHashes discards the result of hashIndex after the tree changes.
+func (f *FS) clearHashes() {
+	f.hashMu.Lock()
+	f.hashes = nil
+	f.hashMu.Unlock()
+}
+
+// walkFiles calls fn on each file in the subtree at n,
+// with n.fs.treeMu held for reading.
+func (n *FSNode) walkFiles(fn func(*FSNode)) error {
+	if err := n.load(); err != nil {
+		return err
+	}
+
+	var dirs []*FSNode
+
+	n.fs.treeMu.RLock()
+	for _, child := range n.children {
+		if child.isDir() {
+			dirs = append(dirs, child)
+		} else {
+			fn(child)
+		}
+	}
+	n.fs.treeMu.RUnlock()
+
+	for _, dir := range dirs {
+		if err := dir.walkFiles(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// byHashDir is the .by-hash directory.
+// Any object in the bucket can be looked up in it,
+// but only those of files in the tree are listed.
+type byHashDir struct {
+	fs *FS
+
+	mu    sync.Mutex
+	nodes map[string]*FSNode // the objects looked up so far
+}
+
+func (d *byHashDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = d.fs.virtualInode(byHashName, "")
+	a.Nlink = 2
+	d.fs.setOwner(a, os.ModeDir|0555)
+	return nil
+}
+
+func (d *byHashDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if !isHash(name) {
+		return nil, syscall.ENOENT
+	}
+
+	d.mu.Lock()
+	node, ok := d.nodes[name]
+	d.mu.Unlock()
+	if ok {
+		return node, nil
+	}
+
+	size, timestamp, ok, err := d.fs.fileWithHash(name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// Not a file in the tree, but perhaps an object in the bucket.
+		var attrs *storage.ObjectAttrs
+		err := withRetries(d.fs.conf.Retry.newBackoff(ctx), func() error {
+			var err error
+			attrs, err = d.fs.bucket.Object(name).Attrs(ctx)
+			return err
+		})
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, syscall.ENOENT
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting attrs of %s", name)
+		}
+		size, timestamp = uint64(attrs.Size), attrs.Created
+	}
+
+	path := byHashName + "/" + name
+	node = &FSNode{
+		fs:        d.fs,
+		inode:     d.fs.virtualInode(path, name),
+		path:      path,
+		hash:      name,
+		timestamp: timestamp,
+		size:      size,
+		virtual:   true,
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if existing, ok := d.nodes[name]; ok {
+		// Looked up concurrently.
+		return existing, nil
+	}
+	if d.nodes == nil {
+		d.nodes = make(map[string]*FSNode)
+	}
+	d.nodes[name] = node
+	return node, nil
+}
+
+// fileWithHash looks in the tree for a file with the given hash,
+// reporting its size and the earliest time it was saved.
+// For a tree loaded from an index,
+// only the files found by an earlier call to hashIndex are looked at,
+// since finding the rest would mean loading every directory.
+func (f *FS) fileWithHash(hash string) (size uint64, timestamp time.Time, ok bool, err error) {
+	f.hashMu.Lock()
+	hashes := f.hashes
+	f.hashMu.Unlock()
+
+	if hashes == nil && f.idx == nil {
+		if hashes, err = f.hashIndex(); err != nil {
+			return 0, time.Time{}, false, err
+		}
+	}
+
+	nodes := hashes[hash]
+	if len(nodes) == 0 {
+		return 0, time.Time{}, false, nil
+	}
+
+	f.treeMu.RLock()
+	defer f.treeMu.RUnlock()
+
+	size, timestamp = nodes[0].size, nodes[0].timestamp
+	for _, n := range nodes[1:] {
+		if n.timestamp.Before(timestamp) {
+			timestamp = n.timestamp
+		}
+	}
+	return size, timestamp, true, nil
+}
+
+func (d *byHashDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	hashes, err := d.fs.hashIndex()
+	if err != nil {
+		return nil, err
+	}
+	var result []fuse.Dirent
+	for _, hash := range maps.Keys(hashes) {
+		result = append(result, fuse.Dirent{
+			Inode: d.fs.virtualInode(byHashName+"/"+hash, hash),
+			Type:  fuse.DT_File,
+			Name:  hash,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// dupsDir is the .duplicates directory.
+type dupsDir struct {
+	fs *FS
+}
+
+func (d *dupsDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = d.fs.virtualInode(duplicatesName, "")
+	a.Nlink = 2
+	d.fs.setOwner(a, os.ModeDir|0555)
+	return nil
+}
+
+func (d *dupsDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	hashes, err := d.fs.hashIndex()
+	if err != nil {
+		return nil, err
+	}
+	if nodes := hashes[name]; len(nodes) > 1 {
+		return &dupGroup{fs: d.fs, hash: name, nodes: nodes}, nil
+	}
+	return nil, syscall.ENOENT
+}
+
+func (d *dupsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	hashes, err := d.fs.hashIndex()
+	if err != nil {
+		return nil, err
+	}
+	var result []fuse.Dirent
+	for hash, nodes := range hashes {
+		if len(nodes) < 2 {
+			continue
+		}
+		result = append(result, fuse.Dirent{
+			Inode: d.fs.virtualInode(duplicatesName+"/"+hash, ""),
+			Type:  fuse.DT_Dir,
+			Name:  hash,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// dupGroup is a subdirectory of .duplicates,
+// with a symlink to each file having the given hash.
+// Each symlink is named for the path of its file,
+// with % and / escaped as %25 and %2F.
+type dupGroup struct {
+	fs    *FS
+	hash  string
+	nodes []*FSNode
+}
+
+var linkNameEscaper = strings.NewReplacer("%", "%25", "/", "%2F")
+
+func (g *dupGroup) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = g.fs.virtualInode(duplicatesName+"/"+g.hash, "")
+	a.Nlink = 2
+	g.fs.setOwner(a, os.ModeDir|0555)
+	return nil
+}
+
+// links returns the group's symlinks, in order by the paths of their files.
+func (g *dupGroup) links() []*dupLink {
+	var (
+		top    = g.fs.top.path
+		result []*dupLink
+	)
+	for _, n := range g.nodes {
+		rel := n.path
+		if top != "" {
+			rel = strings.TrimPrefix(rel, top+"/")
+		}
+		name := linkNameEscaper.Replace(rel)
+		result = append(result, &dupLink{
+			inode:  g.fs.virtualInode(duplicatesName+"/"+g.hash+"/"+name, g.hash),
+			name:   name,
+			target: "../../" + rel,
+		})
+	}
+	return result
+}
+
+func (g *dupGroup) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	for _, link := range g.links() {
+		if link.name == name {
+			return link, nil
+		}
+	}
+	return nil, syscall.ENOENT
+}
+
+func (g *dupGroup) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var result []fuse.Dirent
+	for _, link := range g.links() {
+		result = append(result, fuse.Dirent{
+			Inode: link.inode,
+			Type:  fuse.DT_Link,
+			Name:  link.name,
+		})
+	}
+	return result, nil
+}
+
+// dupLink is a symlink in a subdirectory of .duplicates.
+type dupLink struct {
+	inode        uint64
+	name, target string
+}
+
+func (l *dupLink) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = l.inode
+	a.Mode = os.ModeSymlink | 0777
+	a.Size = uint64(len(l.target))
+	return nil
+}
+
+func (l *dupLink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	return l.target, nil
+}
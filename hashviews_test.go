@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/seaweedfs/fuse"
+)
+
+func TestByHashLookup(t *testing.T) {
+	ctx := context.Background()
+
+	var (
+		hash = "sha256-ab0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcd"
+		t0   = time.Unix(1700000000, 0)
+		t1   = t0.Add(time.Hour)
+	)
+	if !isHash(hash) {
+		t.Fatalf("%s is not a valid hash", hash)
+	}
+
+	listfile := filepath.Join(t.TempDir(), "list.json")
+	j, err := json.Marshal(listType{
+		Hash: hash,
+		Size: 42,
+		Paths: map[string]time.Time{
+			"host:/a/x": t1,
+			"host:/b/y": t0,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(listfile, j, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// With no bucket, a lookup that went to the bucket would panic.
+	f, err := newFS(ctx, nil, retryConf{}, listfile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := f.byHash.Lookup(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a fuse.Attr
+	if err := node.Attr(ctx, &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Size != 42 {
+		t.Errorf("got size %d, want 42", a.Size)
+	}
+	if !a.Mtime.Equal(t0) {
+		t.Errorf("got mtime %s, want %s", a.Mtime, t0)
+	}
+
+	again, err := f.byHash.Lookup(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != node {
+		t.Error("second lookup produced a different node")
+	}
+}
+
+func TestByHashReadOnly(t *testing.T) {
+	ctx := context.Background()
+
+	hash := "sha256-ab0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcd"
+
+	listfile := filepath.Join(t.TempDir(), "list.json")
+	j, err := json.Marshal(listType{
+		Hash:  hash,
+		Size:  42,
+		Paths: map[string]time.Time{"host:/a/x": time.Unix(1700000000, 0)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(listfile, j, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := newFS(ctx, nil, retryConf{}, listfile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.wait(); err != nil {
+		t.Fatal(err)
+	}
+	// Writable, though nothing here should get far enough to need any of rwState.
+	f.rw = &rwState{}
+
+	node, err := f.byHash.Lookup(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := node.(*FSNode)
+
+	for _, flags := range []fuse.OpenFlags{fuse.OpenWriteOnly, fuse.OpenReadWrite, fuse.OpenWriteOnly | fuse.OpenTruncate} {
+		if _, err := n.Open(ctx, &fuse.OpenRequest{Flags: flags}, &fuse.OpenResponse{}); !errors.Is(err, syscall.EROFS) {
+			t.Errorf("opening with flags %v: got error %v, want %v", flags, err, syscall.EROFS)
+		}
+	}
+	if _, err := n.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{}); err != nil {
+		t.Errorf("opening read-only: %s", err)
+	}
+
+	err = n.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 0}, &fuse.SetattrResponse{})
+	if !errors.Is(err, syscall.EROFS) {
+		t.Errorf("truncating: got error %v, want %v", err, syscall.EROFS)
+	}
+
+	attrers := map[string]interface {
+		Attr(context.Context, *fuse.Attr) error
+	}{
+		"file":         n,
+		byHashName:     f.byHash,
+		duplicatesName: f.virtualDir(duplicatesName),
+	}
+	for name, attrer := range attrers {
+		var a fuse.Attr
+		if err := attrer.Attr(ctx, &a); err != nil {
+			t.Fatal(err)
+		}
+		if a.Mode&0222 != 0 {
+			t.Errorf("%s: got mode %v, want no write permission", name, a.Mode)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// version is one distinct content saved at a given path.
+type version struct {
+	hash       string
+	size       int64
+	timestamps []time.Time
+}
+
+func (c maincmd) doHistory(ctx context.Context, listfile, cat string, path string, _ []string) error {
+	versions, err := pathHistory(ctx, c, listfile, path)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return fmt.Errorf("%s not found", path)
+	}
+
+	if cat != "" {
+		v, err := selectVersion(versions, cat)
+		if err != nil {
+			return err
+		}
+		return c.copyObject(ctx, os.Stdout, v.hash, 0, -1)
+	}
+
+	for i, v := range versions {
+		var times []string
+		for _, t := range v.timestamps {
+			times = append(times, t.Format(time.RFC3339))
+		}
+		fmt.Printf("%d  %s  %d bytes  saved %s\n", i+1, v.hash, v.size, strings.Join(times, ", "))
+	}
+
+	return nil
+}
+
+// pathHistory returns every version saved at path,
+// oldest first.
+func pathHistory(ctx context.Context, c maincmd, listfile, path string) ([]*version, error) {
+	found, err := findPaths(ctx, c, listfile, &listFilter{path: path})
+	if err != nil {
+		return nil, err
+	}
+
+	// The same path may have been recorded under more than one key
+	// (e.g. with and without a leading slash),
+	// so merge all the sightings.
+	byHash := make(map[string]*version)
+	for _, sightings := range found {
+		for _, s := range sightings {
+			v, ok := byHash[s.hash]
+			if !ok {
+				v = &version{hash: s.hash, size: s.size}
+				byHash[s.hash] = v
+			}
+			v.timestamps = append(v.timestamps, s.timestamp)
+		}
+	}
+
+	var versions []*version
+	for _, v := range byHash {
+		sort.Slice(v.timestamps, func(i, j int) bool { return v.timestamps[i].Before(v.timestamps[j]) })
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].timestamps[0].Before(versions[j].timestamps[0]) })
+
+	return versions, nil
+}
+
+// selectVersion finds a version by its number in the history output
+// (where 1 is the oldest)
+// or by its hash.
+func selectVersion(versions []*version, which string) (*version, error) {
+	if n, err := strconv.Atoi(which); err == nil {
+		if n < 1 || n > len(versions) {
+			return nil, fmt.Errorf("version %d out of range (there are %d)", n, len(versions))
+		}
+		return versions[n-1], nil
+	}
+	if !strings.HasPrefix(which, "sha256-") {
+		which = "sha256-" + which
+	}
+	for _, v := range versions {
+		if v.hash == which {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("no version with hash %s", which)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	_ "modernc.org/sqlite"
+)
+
+// An index is a SQLite database holding the same information as list output,
+// arranged so that a directory's contents can be looked up without loading the whole tree.
+// It is built with list -db,
+// and can be given anywhere a list file can.
+
+const indexSchema = `
+CREATE TABLE objects (
+  hash TEXT NOT NULL PRIMARY KEY,
+  size INTEGER NOT NULL,
+  generation INTEGER NOT NULL,
+  metageneration INTEGER NOT NULL
+);
+
+CREATE TABLE paths (
+  key TEXT NOT NULL,  -- as recorded in the object's paths metadata
+  dir TEXT NOT NULL,  -- the tree path of the containing directory
+  name TEXT NOT NULL, -- the last element of the tree path
+  hash TEXT NOT NULL,
+  timestamp INTEGER NOT NULL,
+  PRIMARY KEY (key, hash)
+);
+
+CREATE INDEX paths_dir ON paths (dir, name);
+CREATE INDEX paths_hash ON paths (hash);
+
+CREATE TABLE dirs (
+  path TEXT NOT NULL PRIMARY KEY,
+  dir TEXT NOT NULL,
+  name TEXT NOT NULL
+);
+
+CREATE INDEX dirs_dir ON dirs (dir, name);
+`
+
+// sqliteMagic is the header at the start of every SQLite database file.
+var sqliteMagic = []byte("SQLite format 3\x00")
+
+// isIndexFile tells whether the named file is an index
+// (as opposed to a file of list output).
+func isIndexFile(filename string) (bool, error) {
+	if filename == "" || filename == "-" {
+		return false, nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, len(sqliteMagic))
+	if _, err := io.ReadFull(f, buf); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bytes.Equal(buf, sqliteMagic), nil
+}
+
+func openIndex(filename string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file:"+filename+"?mode=ro")
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening index %s", filename)
+	}
+	return db, nil
+}
+
+// indexBuilder creates an index from a stream of list entries.
+type indexBuilder struct {
+	tx       *sql.Tx
+	objStmt  *sql.Stmt
+	pathStmt *sql.Stmt
+	dirStmt  *sql.Stmt
+	dirs     map[string]bool
+}
+
+// buildIndex creates an index in the named file,
+// replacing any file that is already there.
+// It calls fill with a function for adding entries to the index.
+func buildIndex(ctx context.Context, filename string, fill func(add func(listType) error) error) error {
+	tmpfile := filename + ".tmp"
+	if err := os.Remove(tmpfile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrapf(err, "removing %s", tmpfile)
+	}
+	defer os.Remove(tmpfile)
+
+	db, err := sql.Open("sqlite", "file:"+tmpfile)
+	if err != nil {
+		return errors.Wrapf(err, "creating %s", tmpfile)
+	}
+	defer db.Close()
+
+	if _, err := db.ExecContext(ctx, "PRAGMA journal_mode = OFF; PRAGMA synchronous = OFF;"); err != nil {
+		return errors.Wrap(err, "configuring index")
+	}
+	if _, err := db.ExecContext(ctx, indexSchema); err != nil {
+		return errors.Wrap(err, "creating index schema")
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	b, err := newIndexBuilder(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if err := fill(func(l listType) error { return b.add(ctx, l) }); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing index")
+	}
+	if err := db.Close(); err != nil {
+		return errors.Wrap(err, "closing index")
+	}
+	return os.Rename(tmpfile, filename)
+}
+
+func newIndexBuilder(ctx context.Context, tx *sql.Tx) (*indexBuilder, error) {
+	b := &indexBuilder{
+		tx:   tx,
+		dirs: map[string]bool{"": true},
+	}
+	var err error
+	if b.objStmt, err = tx.PrepareContext(ctx, "INSERT OR REPLACE INTO objects (hash, size, generation, metageneration) VALUES (?, ?, ?, ?)"); err != nil {
+		return nil, errors.Wrap(err, "preparing objects statement")
+	}
+	if b.pathStmt, err = tx.PrepareContext(ctx, "INSERT OR REPLACE INTO paths (key, dir, name, hash, timestamp) VALUES (?, ?, ?, ?, ?)"); err != nil {
+		return nil, errors.Wrap(err, "preparing paths statement")
+	}
+	if b.dirStmt, err = tx.PrepareContext(ctx, "INSERT OR IGNORE INTO dirs (path, dir, name) VALUES (?, ?, ?)"); err != nil {
+		return nil, errors.Wrap(err, "preparing dirs statement")
+	}
+	return b, nil
+}
+
+// openIndexForUpdate opens an existing index for adding entries with appendIndex.
+func openIndexForUpdate(filename string) (*sql.DB, error) {
+	// The index may also be open for reading elsewhere in the process,
+	// as it is for the prescan in save.
+	db, err := sql.Open("sqlite", "file:"+filename+"?_pragma=busy_timeout(10000)")
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening index %s", filename)
+	}
+	return db, nil
+}
+
+// appendIndex adds the entry for a new or updated object to an index,
+// replacing any earlier entry for the same object.
+func appendIndex(ctx context.Context, db *sql.DB, l listType) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM paths WHERE hash = ?", l.Hash); err != nil {
+		return errors.Wrapf(err, "removing old paths of %s from index", l.Hash)
+	}
+	b, err := newIndexBuilder(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if err := b.add(ctx, l); err != nil {
+		return err
+	}
+	return errors.Wrap(tx.Commit(), "committing index")
+}
+
+func (b *indexBuilder) add(ctx context.Context, l listType) error {
+	if _, err := b.objStmt.ExecContext(ctx, l.Hash, l.Size, l.Generation, l.Metageneration); err != nil {
+		return errors.Wrapf(err, "adding object %s to index", l.Hash)
+	}
+	for key, timestamp := range l.Paths {
+		dir, name := splitTreePath(treePath(key))
+		if _, err := b.pathStmt.ExecContext(ctx, key, dir, name, l.Hash, timestamp.Unix()); err != nil {
+			return errors.Wrapf(err, "adding path %s to index", key)
+		}
+		for !b.dirs[dir] {
+			b.dirs[dir] = true
+			parent, name := splitTreePath(dir)
+			if _, err := b.dirStmt.ExecContext(ctx, dir, parent, name); err != nil {
+				return errors.Wrapf(err, "adding dir %s to index", dir)
+			}
+			dir = parent
+		}
+	}
+	return nil
+}
+
+// splitTreePath splits a path in the filesystem tree into its directory and last element.
+// The top-level directory is "".
+func splitTreePath(p string) (dir, name string) {
+	p = strings.Trim(p, "/")
+	dir, name = path.Split(p)
+	return strings.TrimSuffix(dir, "/"), name
+}
+
+// loadFromIndex populates the children of the directory node n from the index.
+// Where more than one object has been saved at the same path,
+// the most recently saved one is used.
+func (n *FSNode) loadFromIndex(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM dirs WHERE dir = ?", n.path)
+	if err != nil {
+		return errors.Wrapf(err, "querying index for subdirs of %s", n.path)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return errors.Wrapf(err, "scanning subdirs of %s", n.path)
+		}
+		n.children[name] = n.newDir(name)
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrapf(err, "querying index for subdirs of %s", n.path)
+	}
+
+	rows, err = db.QueryContext(ctx, "SELECT paths.name, paths.hash, objects.size, MAX(paths.timestamp) FROM paths JOIN objects ON paths.hash = objects.hash WHERE paths.dir = ? GROUP BY paths.name", n.path)
+	if err != nil {
+		return errors.Wrapf(err, "querying index for files in %s", n.path)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			name, hash string
+			size, ts   int64
+		)
+		if err := rows.Scan(&name, &hash, &size, &ts); err != nil {
+			return errors.Wrapf(err, "scanning files in %s", n.path)
+		}
+		if _, ok := n.children[name]; ok {
+			// A directory with the same name takes precedence.
+			continue
+		}
+		n.children[name] = &FSNode{
+			fs:        n.fs,
+			inode:     n.fs.inodeFor(joinTreePath(n.path, name), hash),
+			parent:    n,
+			path:      joinTreePath(n.path, name),
+			hash:      hash,
+			timestamp: time.Unix(ts, 0),
+			size:      uint64(size),
+		}
+	}
+	return errors.Wrapf(rows.Err(), "querying index for files in %s", n.path)
+}
+
+// joinTreePath joins a directory and a name in the filesystem tree.
+func joinTreePath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// readIndex calls fn on each entry in an index,
+// in the same form as list output.
+func readIndex(ctx context.Context, filename string, fn func(listType) error) error {
+	db, err := openIndex(filename)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, "SELECT objects.hash, objects.size, objects.generation, objects.metageneration, paths.key, paths.timestamp FROM objects LEFT JOIN paths ON objects.hash = paths.hash ORDER BY objects.hash")
+	if err != nil {
+		return errors.Wrapf(err, "querying index %s", filename)
+	}
+	defer rows.Close()
+
+	var cur *listType
+	for rows.Next() {
+		var (
+			l   listType
+			key sql.NullString
+			ts  sql.NullInt64
+		)
+		if err := rows.Scan(&l.Hash, &l.Size, &l.Generation, &l.Metageneration, &key, &ts); err != nil {
+			return errors.Wrapf(err, "scanning index %s", filename)
+		}
+		if cur != nil && cur.Hash != l.Hash {
+			if err := fn(*cur); err != nil {
+				return err
+			}
+			cur = nil
+		}
+		if cur == nil {
+			l.Paths = make(map[string]time.Time)
+			cur = &l
+		}
+		if key.Valid {
+			cur.Paths[key.String] = time.Unix(ts.Int64, 0)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrapf(err, "querying index %s", filename)
+	}
+	if cur != nil {
+		return fn(*cur)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAppendIndex(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "index.db")
+
+	t0 := time.Unix(1700000000, 0)
+	entries := []listType{
+		{
+			Hash:           "sha256-aaaa",
+			Size:           10,
+			Generation:     1,
+			Metageneration: 1,
+			Paths: map[string]time.Time{
+				"host:/home/alice/a.txt": t0,
+			},
+		},
+		{
+			Hash:           "sha256-bbbb",
+			Size:           20,
+			Generation:     2,
+			Metageneration: 1,
+			Paths: map[string]time.Time{
+				"host:/home/alice/b.txt": t0,
+			},
+		},
+	}
+	err := buildIndex(ctx, filename, func(add func(listType) error) error {
+		for _, l := range entries {
+			if err := add(l); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := isIndexFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("built index is not recognized as one")
+	}
+
+	db, err := openIndexForUpdate(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// An updated object, with a new path in a new directory.
+	entries[1].Metageneration = 2
+	entries[1].Paths["host:/home/bob/b.txt"] = t0.Add(time.Hour)
+	if err := appendIndex(ctx, db, entries[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new object, in an existing directory.
+	entries = append(entries, listType{
+		Hash:           "sha256-cccc",
+		Size:           30,
+		Generation:     3,
+		Metageneration: 1,
+		Paths: map[string]time.Time{
+			"host:/home/alice/c.txt": t0,
+		},
+	})
+	if err := appendIndex(ctx, db, entries[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []listType
+	err = readIndex(ctx, filename, func(l listType) error {
+		got = append(got, l)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, entries) {
+		t.Errorf("got %v, want %v", got, entries)
+	}
+
+	f, err := newFS(ctx, nil, retryConf{}, filename, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.wait(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"host/home/alice/c.txt", "host/home/bob/b.txt"} {
+		if _, err := f.root.findNode(path, false); err != nil {
+			t.Errorf("finding %s: %s", path, err)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	_ "embed"
+	"fmt"
 	"html/template"
 	"io/fs"
 	"log"
@@ -21,30 +22,35 @@ import (
 
 type kodi struct {
 	bucket             *storage.BucketHandle
+	retry              retryConf
 	username, password string
-	node               *FSNode
+	fs                 *FS
+	dir                string // the directory served, or "" for the whole tree
 }
 
 func (c maincmd) doKodi(outerCtx context.Context, dir, listen, username, password, listfile, certfile, keyfile string, _ []string) error {
 	return ctrlc.Run(outerCtx, func(ctx context.Context) error {
 		k := &kodi{
 			bucket:   c.bucket,
+			retry:    c.retry,
 			username: username,
 			password: password,
 		}
 
-		log.Print("Building file system, please wait")
-
-		f, err := newFS(ctx, c.bucket, listfile, "")
+		f, err := newFS(ctx, c.bucket, c.retry, listfile, "")
 		if err != nil {
 			return errors.Wrap(err, "building filesystem")
 		}
-		node, err := f.root.findNode(dir, false)
-		if err != nil {
-			return errors.Wrapf(err, "finding %s", dir)
-		}
+		k.fs = f
+		k.dir = strings.Trim(dir, "/")
 
-		k.node = node
+		// Check the directory once the tree is built,
+		// without holding up the server.
+		go func() {
+			if _, err := k.top(); err != nil {
+				log.Printf("Finding %s: %s", dir, err)
+			}
+		}()
 
 		s := &http.Server{
 			Addr:    listen,
@@ -82,12 +88,17 @@ func (k *kodi) handle(w http.ResponseWriter, req *http.Request) error {
 
 	ctx := req.Context()
 
+	top, err := k.top()
+	if err != nil {
+		return errors.Wrapf(err, "finding %s", k.dir)
+	}
+
 	path := strings.Trim(req.URL.Path, "/")
 	if path == "" {
-		return k.handleDir(ctx, w, k.node)
+		return k.handleDir(ctx, w, top)
 	}
 
-	node, err := k.node.findNode(path, false)
+	node, err := top.findNode(path, false)
 	if errors.Is(err, fs.ErrNotExist) {
 		return mid.CodeErr{C: http.StatusNotFound}
 	}
@@ -98,8 +109,14 @@ func (k *kodi) handle(w http.ResponseWriter, req *http.Request) error {
 		return k.handleDir(ctx, w, node)
 	}
 
-	obj := k.bucket.Object(node.hash)
-	r, err := gcsobj.NewReader(ctx, obj)
+	var (
+		obj = k.bucket.Object(node.hash)
+		r   *gcsobj.Reader
+	)
+	err = withRetries(k.retry.newBackoff(ctx), func() error {
+		r, err = gcsobj.NewReader(ctx, obj)
+		return err
+	})
 	if err != nil {
 		return errors.Wrapf(err, "creating reader for object %s", node.hash)
 	}
@@ -113,9 +130,31 @@ func (k *kodi) handle(w http.ResponseWriter, req *http.Request) error {
 	return nil
 }
 
+// top returns the node for the directory being served.
+// Unless the tree comes from an index,
+// this waits for it to be built.
+func (k *kodi) top() (*FSNode, error) {
+	if k.dir == "" {
+		return k.fs.root, k.fs.root.load()
+	}
+	node, err := k.fs.root.findNode(k.dir, false)
+	if err != nil {
+		return nil, err
+	}
+	if !node.isDir() {
+		return nil, fmt.Errorf("%s is not a directory", k.dir)
+	}
+	return node, nil
+}
+
 func (k *kodi) handleDir(ctx context.Context, w http.ResponseWriter, node *FSNode) error {
+	if err := node.load(); err != nil {
+		return errors.Wrapf(err, "loading %s", node.path)
+	}
+
 	var items []template.URL
 
+	node.fs.treeMu.RLock()
 	keys := maps.Keys(node.children)
 	sort.Strings(keys)
 	for _, key := range keys {
@@ -126,6 +165,7 @@ func (k *kodi) handleDir(ctx context.Context, w http.ResponseWriter, node *FSNod
 			items = append(items, template.URL(key))
 		}
 	}
+	node.fs.treeMu.RUnlock()
 
 	return dirtmpl.Execute(w, items)
 }
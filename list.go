@@ -3,57 +3,268 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"log"
 	"os"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/cenkalti/backoff/v4"
 	"github.com/pkg/errors"
 	"google.golang.org/api/iterator"
 )
 
-func (c maincmd) doList(ctx context.Context, _ []string) error {
-	var (
-		enc   = json.NewEncoder(os.Stdout)
-		query = &storage.Query{Projection: storage.ProjectionNoACL}
-		it    = c.bucket.Objects(ctx, query)
-	)
-	enc.SetIndent("", "  ")
-	for {
-		attrs, err := it.Next()
-		if errors.Is(err, iterator.Done) {
-			return nil
-		}
+func (c maincmd) doList(ctx context.Context, update, dbfile, prefix, since, until string, minSize int64, hash, format string, pathsOnly bool, _ []string) error {
+	if update != "" && dbfile != "" {
+		return fmt.Errorf("-update and -db are mutually exclusive")
+	}
+
+	filter, err := newListFilter(prefix, since, until, minSize, hash)
+	if err != nil {
+		return err
+	}
+	if (update != "" || dbfile != "") && (!filter.empty() || format != "json" || pathsOnly) {
+		return fmt.Errorf("filters and output formats cannot be used with -update or -db")
+	}
+
+	if update != "" {
+		return c.updateList(ctx, update)
+	}
+	if dbfile != "" {
+		return buildIndex(ctx, dbfile, func(add func(listType) error) error {
+			return forEachObject(ctx, c.bucket, c.retry, func(attrs *storage.ObjectAttrs) error {
+				entry, err := listEntry(attrs)
+				if err != nil {
+					return err
+				}
+				return add(entry)
+			})
+		})
+	}
+
+	w, err := newListWriter(os.Stdout, format, pathsOnly)
+	if err != nil {
+		return err
+	}
+	err = forEachObject(ctx, c.bucket, c.retry, func(attrs *storage.ObjectAttrs) error {
+		out, err := listEntry(attrs)
 		if err != nil {
 			return err
 		}
+		out, ok := filter.apply(out)
+		if !ok {
+			return nil
+		}
+		return w.write(out)
+	})
+	if err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+// updateList brings the list file or index at listfile up to date with the bucket.
+// Objects whose generation and metageneration match the existing entry are kept as they are.
+// New and changed objects are added,
+// and entries for objects no longer in the bucket are removed.
+//
+// Every object in the bucket is still listed,
+// since GCS can't list only the objects changed since some earlier time.
+// Only the decoding of unchanged objects' paths metadata is skipped.
+func (c maincmd) updateList(ctx context.Context, listfile string) error {
+	isIndex, err := isIndexFile(listfile)
+	if err != nil {
+		return errors.Wrapf(err, "checking type of %s", listfile)
+	}
+
+	old := make(map[string]listType)
+	err = forEachListEntry(ctx, c.bucket, c.retry, listfile, func(l listType) error {
+		old[l.Hash] = l
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var added, changed, kept int
+	fill := func(write func(listType) error) error {
+		return forEachObject(ctx, c.bucket, c.retry, func(attrs *storage.ObjectAttrs) error {
+			entry, ok := old[attrs.Name]
+			delete(old, attrs.Name)
+
+			switch {
+			case !ok:
+				added++
+			case entry.Generation == attrs.Generation && entry.Metageneration == attrs.Metageneration:
+				kept++
+				return write(entry)
+			default:
+				changed++
+			}
 
-		var paths map[string]int64
-		if len(attrs.Metadata) == 0 {
-			paths = make(map[string]int64)
-		} else {
-			if err = json.Unmarshal([]byte(attrs.Metadata["paths"]), &paths); err != nil {
-				return errors.Wrapf(err, "decoding paths attr for %s", attrs.Name)
+			entry, err := listEntry(attrs)
+			if err != nil {
+				return err
 			}
+			return write(entry)
+		})
+	}
+	if isIndex {
+		err = buildIndex(ctx, listfile, fill)
+	} else {
+		err = writeListFile(listfile, fill)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Updated %s: %d added, %d changed, %d removed, %d unchanged", listfile, added, changed, len(old), kept)
+	return nil
+}
+
+// writeListFile writes list output to the named file,
+// replacing any file that is already there.
+// It calls fill with a function for writing entries.
+func writeListFile(listfile string, fill func(write func(listType) error) error) error {
+	tmpfile := listfile + ".tmp"
+	out, err := os.Create(tmpfile)
+	if err != nil {
+		return errors.Wrapf(err, "creating %s", tmpfile)
+	}
+	defer os.Remove(tmpfile)
+	defer out.Close()
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+
+	err = fill(func(l listType) error {
+		return errors.Wrapf(enc.Encode(l), "JSON-encoding output for %s", l.Hash)
+	})
+	if err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return errors.Wrapf(err, "closing %s", tmpfile)
+	}
+	return errors.Wrapf(os.Rename(tmpfile, listfile), "renaming %s to %s", tmpfile, listfile)
+}
+
+// listEntry produces the list output for a bucket object.
+func listEntry(attrs *storage.ObjectAttrs) (listType, error) {
+	var paths map[string]int64
+	if len(attrs.Metadata) == 0 {
+		paths = make(map[string]int64)
+	} else {
+		if err := json.Unmarshal([]byte(attrs.Metadata["paths"]), &paths); err != nil {
+			return listType{}, errors.Wrapf(err, "decoding paths attr for %s", attrs.Name)
 		}
+	}
 
-		pathtimes := make(map[string]time.Time)
-		for path, unixtime := range paths {
-			pathtimes[path] = time.Unix(unixtime, 0)
+	pathtimes := make(map[string]time.Time)
+	for path, unixtime := range paths {
+		pathtimes[path] = time.Unix(unixtime, 0)
+	}
+
+	return listType{
+		Paths:          pathtimes,
+		Size:           attrs.Size,
+		Hash:           attrs.Name,
+		Generation:     attrs.Generation,
+		Metageneration: attrs.Metageneration,
+	}, nil
+}
+
+// forEachListEntry calls fn on each entry in a file of list output,
+// or in an index,
+// or (if listfile is "") in a scan of the bucket.
+func forEachListEntry(ctx context.Context, bucket *storage.BucketHandle, retry retryConf, listfile string, fn func(listType) error) error {
+	if listfile == "" {
+		return forEachObject(ctx, bucket, retry, func(attrs *storage.ObjectAttrs) error {
+			l, err := listEntry(attrs)
+			if err != nil {
+				return err
+			}
+			return fn(l)
+		})
+	}
+	if ok, err := isIndexFile(listfile); err != nil {
+		return errors.Wrapf(err, "checking type of %s", listfile)
+	} else if ok {
+		return readIndex(ctx, listfile, fn)
+	}
+	return readListFile(listfile, fn)
+}
+
+// readListFile calls fn on each entry in a file of list output.
+// A listfile of "-" means standard input.
+func readListFile(listfile string, fn func(listType) error) error {
+	var r io.Reader = os.Stdin
+	if listfile != "-" {
+		f, err := os.Open(listfile)
+		if err != nil {
+			return errors.Wrapf(err, "opening %s", listfile)
 		}
+		defer f.Close()
+		r = f
+	}
 
-		out := listType{
-			Paths: pathtimes,
-			Size:  attrs.Size,
-			Hash:  attrs.Name,
+	dec := json.NewDecoder(r)
+	for dec.More() {
+		var l listType
+		if err := dec.Decode(&l); err != nil {
+			return errors.Wrapf(err, "JSON-decoding %s", listfile)
 		}
-		if err = enc.Encode(out); err != nil {
-			return errors.Wrapf(err, "JSON-encoding output for %s", attrs.Name)
+		if err := fn(l); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// forEachObject calls fn with the attributes of each object in the bucket,
+// skipping temporary objects.
+// If listing the bucket fails with a retryable error,
+// it resumes after the last object seen.
+// Errors from fn are not retried.
+func forEachObject(ctx context.Context, bucket *storage.BucketHandle, retry retryConf, fn func(*storage.ObjectAttrs) error) error {
+	var last string
+	return withRetries(retry.newBackoff(ctx), func() error {
+		var (
+			query = &storage.Query{Projection: storage.ProjectionNoACL, StartOffset: last}
+			it    = bucket.Objects(ctx, query)
+		)
+		for {
+			attrs, err := it.Next()
+			if errors.Is(err, iterator.Done) {
+				return nil
+			}
+			if err != nil {
+				return errors.Wrap(err, "iterating through bucket objects")
+			}
+			if last != "" && attrs.Name == last {
+				// StartOffset is inclusive.
+				continue
+			}
+			last = attrs.Name
+			if strings.HasPrefix(attrs.Name, tmpPrefix) {
+				continue
+			}
+			if err := fn(attrs); err != nil {
+				return backoff.Permanent(err)
+			}
+		}
+	})
 }
 
 type listType struct {
 	Paths map[string]time.Time `json:"paths"`
 	Size  int64                `json:"size"`
 	Hash  string               `json:"hash"`
+
+	// These identify the version of the object's content and metadata
+	// and are used by list -update to tell which entries have changed.
+	Generation     int64 `json:"generation,omitempty"`
+	Metageneration int64 `json:"metageneration,omitempty"`
 }
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// listFilter selects list entries and the paths within them.
+// Zero-valued fields do not filter anything.
+type listFilter struct {
+	path         string         // paths must be this one (see matchPath)
+	prefix       string         // paths must be at or under this prefix
+	glob         string         // paths must match this glob pattern (see matchGlob)
+	regex        *regexp.Regexp // paths must match this regex
+	since, until time.Time      // paths must have been saved in this time range
+	minSize      int64          // objects must be at least this large
+	maxSize      int64          // objects must be no larger than this
+	hash         string         // objects must have this name
+}
+
+func newListFilter(prefix, since, until string, minSize int64, hash string) (*listFilter, error) {
+	f := &listFilter{
+		prefix:  prefix,
+		minSize: minSize,
+		hash:    hash,
+	}
+	if hash != "" && !strings.HasPrefix(hash, "sha256-") {
+		f.hash = "sha256-" + hash
+	}
+	var err error
+	if since != "" {
+		if f.since, err = parseTime(since); err != nil {
+			return nil, errors.Wrap(err, "parsing -since")
+		}
+	}
+	if until != "" {
+		if f.until, err = parseTime(until); err != nil {
+			return nil, errors.Wrap(err, "parsing -until")
+		}
+	}
+	return f, nil
+}
+
+// empty tells whether the filter selects everything.
+func (f *listFilter) empty() bool {
+	return f.hash == "" && f.minSize == 0 && f.maxSize == 0 && !f.filtersPaths()
+}
+
+// filtersPaths tells whether the filter selects individual paths
+// (as opposed to whole objects).
+func (f *listFilter) filtersPaths() bool {
+	return f.path != "" || f.prefix != "" || f.glob != "" || f.regex != nil || !f.since.IsZero() || !f.until.IsZero()
+}
+
+// apply returns l with only the paths selected by the filter.
+// The boolean result is false if the entry should be omitted altogether.
+func (f *listFilter) apply(l listType) (listType, bool) {
+	if f.hash != "" && l.Hash != f.hash {
+		return l, false
+	}
+	if l.Size < f.minSize {
+		return l, false
+	}
+	if f.maxSize > 0 && l.Size > f.maxSize {
+		return l, false
+	}
+	if !f.filtersPaths() {
+		return l, true
+	}
+
+	paths := make(map[string]time.Time)
+	for key, t := range l.Paths {
+		if f.path != "" && !matchPath(f.path, key) {
+			continue
+		}
+		if f.prefix != "" && !matchPrefix(f.prefix, key) {
+			continue
+		}
+		if f.glob != "" && !matchGlob(f.glob, key) {
+			continue
+		}
+		if f.regex != nil && !f.regex.MatchString(key) {
+			continue
+		}
+		if !f.since.IsZero() && t.Before(f.since) {
+			continue
+		}
+		if !f.until.IsZero() && t.After(f.until) {
+			continue
+		}
+		paths[key] = t
+	}
+	if len(paths) == 0 {
+		return l, false
+	}
+	l.Paths = paths
+	return l, true
+}
+
+// matchPath tells whether p names the path recorded under key.
+// It may be given either as the key itself (e.g. HOST:/PATH)
+// or as a path in the filesystem tree (e.g. HOST/PATH).
+func matchPath(p, key string) bool {
+	return p == key || strings.Trim(p, "/") == strings.Trim(treePath(key), "/")
+}
+
+// matchPrefix tells whether the path recorded under key is at or under prefix.
+// As with matchPath,
+// the prefix may be given either as a key (e.g. HOST:/PATH)
+// or as a path in the filesystem tree (e.g. HOST/PATH).
+func matchPrefix(prefix, key string) bool {
+	prefix = strings.Trim(treePath(prefix), "/")
+	if prefix == "" {
+		return true
+	}
+	return isWithin(strings.Trim(treePath(key), "/"), prefix)
+}
+
+// matchGlob tells whether the path recorded under key matches a glob pattern.
+// A pattern containing a slash must match the whole path
+// (not including any host namespace);
+// otherwise it need only match the last element.
+func matchGlob(pattern, key string) bool {
+	_, p := splitKey(key)
+	if !strings.Contains(pattern, "/") {
+		p = path.Base(p)
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+// parseTime parses a time given on the command line,
+// either in RFC3339 format or as a local date and optional time.
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse time %s (want RFC3339 or YYYY-MM-DD)", s)
+}
+
+// listWriter writes list entries in some format.
+type listWriter interface {
+	write(listType) error
+	flush() error
+}
+
+func newListWriter(w io.Writer, format string, pathsOnly bool) (listWriter, error) {
+	if pathsOnly {
+		return &pathsOnlyWriter{w: w, seen: make(map[string]bool)}, nil
+	}
+	switch format {
+	case "", "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return jsonWriter{enc: enc}, nil
+	case "ndjson":
+		return jsonWriter{enc: json.NewEncoder(w)}, nil
+	case "tsv":
+		cw := csv.NewWriter(w)
+		cw.Comma = '\t'
+		return rowWriter{w: cw}, nil
+	case "csv":
+		return rowWriter{w: csv.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown format %s (want json, ndjson, tsv, or csv)", format)
+}
+
+// jsonWriter writes one JSON object per list entry.
+// This is the format that newFS reads.
+type jsonWriter struct {
+	enc *json.Encoder
+}
+
+func (w jsonWriter) write(l listType) error {
+	return errors.Wrapf(w.enc.Encode(l), "JSON-encoding output for %s", l.Hash)
+}
+
+func (jsonWriter) flush() error { return nil }
+
+// rowWriter writes one row per path, with the columns path, hash, size, and time.
+type rowWriter struct {
+	w *csv.Writer
+}
+
+func (w rowWriter) write(l listType) error {
+	for _, key := range sortedKeys(l.Paths) {
+		row := []string{key, l.Hash, strconv.FormatInt(l.Size, 10), l.Paths[key].Format(time.RFC3339)}
+		if err := w.w.Write(row); err != nil {
+			return errors.Wrapf(err, "writing row for %s", key)
+		}
+	}
+	return nil
+}
+
+func (w rowWriter) flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// pathsOnlyWriter writes each distinct path once, one per line.
+type pathsOnlyWriter struct {
+	w    io.Writer
+	seen map[string]bool
+}
+
+func (w *pathsOnlyWriter) write(l listType) error {
+	for _, key := range sortedKeys(l.Paths) {
+		if w.seen[key] {
+			continue
+		}
+		w.seen[key] = true
+		if _, err := fmt.Fprintln(w.w, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (*pathsOnlyWriter) flush() error { return nil }
+
+func sortedKeys(m map[string]time.Time) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
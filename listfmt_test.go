@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestListFilterPrefix(t *testing.T) {
+	t0 := time.Unix(1700000000, 0)
+	l := listType{
+		Hash: "sha256-aaaa",
+		Size: 10,
+		Paths: map[string]time.Time{
+			"/home/me/a.txt":          t0,
+			"/home/meow/b.txt":        t0,
+			"/srv/c.txt":              t0,
+			"myhost:/home/me/d.txt":   t0,
+			"myhost:/home/meow/e.txt": t0,
+			"other:/home/me/f.txt":    t0,
+		},
+	}
+
+	cases := []struct {
+		prefix string
+		want   []string
+	}{
+		{prefix: "/home/me", want: []string{"/home/me/a.txt"}},
+		{prefix: "/home/me/", want: []string{"/home/me/a.txt"}},
+		{prefix: "home/me", want: []string{"/home/me/a.txt"}},
+		{prefix: "myhost:/home/me", want: []string{"myhost:/home/me/d.txt"}},
+		{prefix: "myhost/home/me", want: []string{"myhost:/home/me/d.txt"}},
+		{prefix: "/myhost/home/me", want: []string{"myhost:/home/me/d.txt"}},
+		{prefix: "myhost", want: []string{"myhost:/home/me/d.txt", "myhost:/home/meow/e.txt"}},
+		{prefix: "myhost:/", want: []string{"myhost:/home/me/d.txt", "myhost:/home/meow/e.txt"}},
+		{prefix: "myhost/home/me/d.txt", want: []string{"myhost:/home/me/d.txt"}},
+		{prefix: "/nowhere"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.prefix, func(t *testing.T) {
+			f, err := newListFilter(c.prefix, "", "", 0, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := f.apply(l)
+			if ok != (len(c.want) > 0) {
+				t.Fatalf("got ok %v, want %v", ok, len(c.want) > 0)
+			}
+			if !ok {
+				return
+			}
+			var keys []string
+			for key := range got.Paths {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, c.want) {
+				t.Errorf("got %v, want %v", keys, c.want)
+			}
+		})
+	}
+}
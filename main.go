@@ -8,6 +8,7 @@ import (
 	"flag"
 	"log"
 	"math"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/bobg/subcmd/v2"
@@ -20,6 +21,10 @@ func main() {
 		credsFile  = flag.String("creds", "creds.json", "filename for JSON-encoded credentials")
 		bucketName = flag.String("bucket", "", "bucket name")
 		throttle   = flag.Int("throttle", 0, "upload bytes per second (default 0 is unlimited)")
+
+		retries      = flag.Uint64("retries", defaultRetries, "how many times to retry failed GCS operations")
+		retryInitial = flag.Duration("retry-initial", defaultRetryInitial, "interval before the first retry")
+		retryMax     = flag.Duration("retry-max", defaultRetryMax, "longest interval between retries")
 	)
 	flag.Parse()
 
@@ -44,6 +49,11 @@ func main() {
 		bucketname: *bucketName,
 		bucket:     bucket,
 		limiter:    limiter,
+		retry: retryConf{
+			Retries: *retries,
+			Initial: *retryInitial,
+			Max:     *retryMax,
+		},
 	}
 
 	if err := subcmd.Run(ctx, c, flag.Args()); err != nil {
@@ -55,6 +65,7 @@ type maincmd struct {
 	bucketname string
 	bucket     *storage.BucketHandle
 	limiter    *rate.Limiter
+	retry      retryConf
 }
 
 func (c maincmd) Subcmds() subcmd.Map {
@@ -62,12 +73,72 @@ func (c maincmd) Subcmds() subcmd.Map {
 		"save", c.doSave, "save files to GCS", subcmd.Params(
 			"-exclude-from", subcmd.String, "", "file of exclude patterns (unanchored regexes)",
 			"-list", subcmd.String, "", "prescan from a file of list output; use - to read from stdin",
+			"-one-file-system", subcmd.Bool, false, "do not cross filesystem boundaries",
+			"-skip-fstypes", subcmd.String, defaultSkipFSTypes, "comma-separated filesystem types never to descend into",
+			"-host", subcmd.String, "", "host namespace for saved paths (default none)",
+			"-strip-prefix", subcmd.String, "", "remove this prefix from saved paths",
+			"-as", subcmd.Value, &pathRules{}, "record paths under FROM as if under TO (FROM=TO, may be repeated)",
+			"-pre-hook", subcmd.String, "", "shell command to run before saving",
+			"-post-hook", subcmd.String, "", "shell command to run after saving",
+			"-snapshot", subcmd.String, "", "save from a read-only snapshot (btrfs or zfs)",
+			"-resumable-size", subcmd.Int64, int64(defaultResumableSize), "upload files at least this large in resumable parts (0 means never)",
+			"-state-dir", subcmd.String, "", "directory for resumable-upload state (default is in the user cache dir)",
+			"-tmp-max-age", subcmd.Duration, defaultTmpMaxAge, "delete temporary objects left by interrupted uploads once they are this old (0 means never)",
+			"-append-list", subcmd.Bool, false, "append entries for new and updated objects to the -list file",
+		),
+		"list", c.doList, "list bucket objects", subcmd.Params(
+			"-update", subcmd.String, "", "update this file of earlier list output in place (still lists the whole bucket)",
+			"-db", subcmd.String, "", "write an index database to this file instead of list output",
+			"-prefix", subcmd.String, "", "list only paths at or under this one",
+			"-since", subcmd.String, "", "list only paths saved at or after this time",
+			"-until", subcmd.String, "", "list only paths saved at or before this time",
+			"-min-size", subcmd.Int64, int64(0), "list only objects at least this large",
+			"-hash", subcmd.String, "", "list only the object with this hash",
+			"-format", subcmd.String, "json", "output format: json, ndjson, tsv, or csv",
+			"-paths-only", subcmd.Bool, false, "output only paths, one per line",
+		),
+		"find", c.doFind, "search for backed-up paths", subcmd.Params(
+			"-list", subcmd.String, "", "search list output or an index instead of the bucket; use - to read from stdin",
+			"-glob", subcmd.String, "", "glob pattern for file names (or whole paths, if it contains a /)",
+			"-regex", subcmd.String, "", "regular expression for paths",
+			"-min-size", subcmd.Int64, int64(0), "minimum file size",
+			"-max-size", subcmd.Int64, int64(0), "maximum file size",
+			"-since", subcmd.String, "", "earliest time saved",
+			"-until", subcmd.String, "", "latest time saved",
+			"-hash", subcmd.String, "", "file hash",
+		),
+		"history", c.doHistory, "show every saved version of a path", subcmd.Params(
+			"-list", subcmd.String, "", "read list output or an index instead of the bucket; use - to read from stdin",
+			"-cat", subcmd.String, "", "write this version (a number from the history output, or a hash) to stdout",
+			"path", subcmd.String, "", "path to show",
+		),
+		"cat", c.doCat, "write a backed-up file to stdout", subcmd.Params(
+			"-list", subcmd.String, "", "resolve paths with list output or an index instead of the bucket; use - to read from stdin",
+			"-offset", subcmd.Int64, int64(0), "starting byte offset",
+			"-length", subcmd.Int64, int64(-1), "number of bytes (-1 means to the end)",
+			"file", subcmd.String, "", "path or hash of file",
+		),
+		"get", c.doGet, "copy a backed-up file to a local file", subcmd.Params(
+			"-list", subcmd.String, "", "resolve paths with list output or an index instead of the bucket; use - to read from stdin",
+			"-offset", subcmd.Int64, int64(0), "starting byte offset",
+			"-length", subcmd.Int64, int64(-1), "number of bytes (-1 means to the end)",
+			"file", subcmd.String, "", "path or hash of file",
+			"dest", subcmd.String, "", "local file or directory to write",
+		),
+		"du", c.doDU, "report storage used by directory", subcmd.Params(
+			"-list", subcmd.String, "", "build file system from list output or an index instead of the bucket; use - to read from stdin",
+			"-dir", subcmd.String, "", "directory to report on",
+			"-depth", subcmd.Int, 1, "report subdirectories down to this depth",
+			"-top", subcmd.Int, 10, "report only this many of the largest subdirectories (0 for all)",
+			"-format", subcmd.String, "text", "output format: text or json",
 		),
-		"list", c.doList, "list bucket objects", nil,
 		"fs", c.doFS, "serve a FUSE filesystem", subcmd.Params(
 			"-name", subcmd.String, c.bucketname, "file system name",
-			"-list", subcmd.String, "", "build file system from list output; use - to read from stdin",
+			"-list", subcmd.String, "", "build file system from list output or an index (only an index is loaded lazily); use - to read from stdin",
 			"-conf", subcmd.String, "", "path to config file",
+			"-dir", subcmd.String, "", "directory to serve",
+			"-refresh", subcmd.Duration, time.Duration(0), "how often to refresh the file system from the bucket or list file (0 means only on SIGHUP)",
+			"-rw", subcmd.Bool, false, "allow writing; new and changed files are saved to the bucket (not with -list)",
 			"mount", subcmd.String, "", "mount point",
 		),
 		"kodi", c.doKodi, "serve a gcsbackup file tree to Kodi", subcmd.Params(
@@ -75,7 +146,7 @@ func (c maincmd) Subcmds() subcmd.Map {
 			"-listen", subcmd.String, ":1549", "listen address",
 			"-username", subcmd.String, "", "HTTP Basic Auth username",
 			"-password", subcmd.String, "", "HTTP Basic Auth password", // TODO: move this to an env var
-			"-list", subcmd.String, "", "build file system from list output; use - to read from stdin",
+			"-list", subcmd.String, "", "build file system from list output or an index (only an index is loaded lazily); use - to read from stdin",
 			"-cert", subcmd.String, "", "path to cert file",
 			"-key", subcmd.String, "", "path to key file",
 		),
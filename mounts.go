@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/fs"
+	"strings"
+	"syscall"
+)
+
+// defaultSkipFSTypes is the default list of filesystem types
+// that save will not descend into.
+// These are virtual filesystems whose "files" are not worth backing up
+// (and some of which, like /proc, are effectively infinite).
+const defaultSkipFSTypes = "proc,sysfs,devpts,cgroup,cgroup2,debugfs,tracefs,securityfs,pstore,bpf,mqueue,hugetlbfs,fusectl,configfs,binfmt_misc,autofs,nsfs,efivarfs,selinuxfs,rpc_pipefs"
+
+// parseFSTypes turns a comma-separated list of filesystem type names into a set.
+func parseFSTypes(s string) map[string]bool {
+	result := make(map[string]bool)
+	for _, typ := range strings.Split(s, ",") {
+		typ = strings.TrimSpace(typ)
+		if typ == "" {
+			continue
+		}
+		result[typ] = true
+	}
+	return result
+}
+
+// devOf returns the ID of the device containing the file described by info.
+// The boolean result is false if the platform does not supply that information.
+func devOf(info fs.FileInfo) (uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true
+}
+
+// specialFileReason returns a description of the type of file described by mode
+// if it is anything other than a regular file or a directory,
+// and the empty string otherwise.
+func specialFileReason(mode fs.FileMode) string {
+	switch {
+	case mode.IsRegular(), mode.IsDir():
+		return ""
+	case mode&fs.ModeSymlink != 0:
+		return "symlink"
+	case mode&fs.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	case mode&fs.ModeCharDevice != 0:
+		return "character device"
+	case mode&fs.ModeDevice != 0:
+		return "device"
+	default:
+		return "irregular file"
+	}
+}
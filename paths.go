@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// canonicalPath converts path to an absolute path with no symlinks.
+func canonicalPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// checkHost checks that host is usable as a host namespace.
+func checkHost(host string) error {
+	if strings.ContainsAny(host, ":/") {
+		return fmt.Errorf("host name %s may not contain ':' or '/'", host)
+	}
+	return nil
+}
+
+// indexKey produces the key under which path is recorded in an object's paths metadata.
+// If host is non-empty,
+// the key has the form HOST:PATH.
+func indexKey(host, path string) string {
+	if host == "" {
+		return path
+	}
+	return host + ":" + path
+}
+
+// splitKey splits a key from an object's paths metadata into its host and path.
+// The host is empty for keys recorded without one.
+func splitKey(key string) (host, path string) {
+	colon := strings.Index(key, ":/")
+	if colon <= 0 || strings.Contains(key[:colon], "/") {
+		return "", key
+	}
+	return key[:colon], key[colon+1:]
+}
+
+// treePath converts a key from an object's paths metadata
+// to a path in the filesystem tree.
+// Hosts appear as top-level directories,
+// so HOST:/PATH becomes HOST/PATH.
+// Keys without a host are unchanged.
+func treePath(key string) string {
+	host, path := splitKey(key)
+	if host == "" {
+		return path
+	}
+	return host + path
+}
+
+// pathRule rewrites paths beginning with from
+// so that they begin with to instead.
+type pathRule struct {
+	from, to string
+}
+
+// pathRules is a set of path-rewriting rules.
+// It implements flag.Value,
+// accepting rules of the form FROM=TO.
+type pathRules []pathRule
+
+var _ flag.Value = &pathRules{}
+
+func (r *pathRules) String() string {
+	var strs []string
+	for _, rule := range *r {
+		strs = append(strs, rule.from+"="+rule.to)
+	}
+	return strings.Join(strs, ",")
+}
+
+func (r *pathRules) Set(s string) error {
+	from, to, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("path rule %s is not of the form FROM=TO", s)
+	}
+	return r.add(from, to)
+}
+
+// add adds a rule rewriting paths under from to paths under to.
+// Like the roots given to save,
+// from is canonicalized if it exists,
+// so that a rule naming it by way of a symlink still matches.
+func (r *pathRules) add(from, to string) error {
+	canon, err := canonicalPath(from)
+	if errors.Is(err, os.ErrNotExist) {
+		canon, err = filepath.Abs(from)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "canonicalizing %s", from)
+	}
+	from = canon
+	if !filepath.IsAbs(to) {
+		return fmt.Errorf("path rule target %s is not absolute", to)
+	}
+	to = filepath.Clean(to)
+	for _, rule := range *r {
+		if rule.from == from {
+			return fmt.Errorf("multiple path rules for %s", from)
+		}
+	}
+	*r = append(*r, pathRule{from: from, to: to})
+	return nil
+}
+
+// apply rewrites path according to the longest matching rule in r.
+// Paths not matching any rule are returned unchanged.
+func (r pathRules) apply(path string) string {
+	var (
+		best  pathRule
+		found bool
+	)
+	for _, rule := range r {
+		if !isWithin(path, rule.from) {
+			continue
+		}
+		if !found || len(rule.from) > len(best.from) {
+			best, found = rule, true
+		}
+	}
+	if !found {
+		return path
+	}
+	rel, err := filepath.Rel(best.from, path)
+	if err != nil {
+		return path
+	}
+	return filepath.Join(best.to, rel)
+}
+
+// checkCollisions reports an error if r maps any two of the given roots
+// to the same or overlapping paths
+// (when the roots themselves do not overlap).
+func (r pathRules) checkCollisions(roots []string) error {
+	for i, root1 := range roots {
+		mapped1 := r.apply(root1)
+		for _, root2 := range roots[i+1:] {
+			if isWithin(root1, root2) || isWithin(root2, root1) {
+				continue
+			}
+			mapped2 := r.apply(root2)
+			if isWithin(mapped1, mapped2) || isWithin(mapped2, mapped1) {
+				return fmt.Errorf("%s (recorded as %s) and %s (recorded as %s) collide", root1, mapped1, root2, mapped2)
+			}
+		}
+	}
+	return nil
+}
+
+// isWithin tells whether path is dir or is a descendant of it.
+func isWithin(path, dir string) bool {
+	if path == dir || dir == "/" {
+		return true
+	}
+	return strings.HasPrefix(path, dir+"/")
+}
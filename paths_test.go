@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathRulesApply(t *testing.T) {
+	rules := pathRules{
+		{from: "/home/alice", to: "/home/bob"},
+		{from: "/home/alice/photos", to: "/photos"},
+		{from: "/mnt/snap", to: "/"},
+	}
+
+	cases := []struct {
+		path, want string
+	}{
+		{path: "/home/alice", want: "/home/bob"},
+		{path: "/home/alice/notes.txt", want: "/home/bob/notes.txt"},
+		{path: "/home/alice/photos", want: "/photos"},
+		{path: "/home/alice/photos/cat.jpg", want: "/photos/cat.jpg"},
+		{path: "/home/alicex/notes.txt", want: "/home/alicex/notes.txt"},
+		{path: "/home/carol/notes.txt", want: "/home/carol/notes.txt"},
+		{path: "/mnt/snap", want: "/"},
+		{path: "/mnt/snap/etc/hosts", want: "/etc/hosts"},
+		{path: "/mnt/snapshot/etc/hosts", want: "/mnt/snapshot/etc/hosts"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			if got := rules.apply(tc.path); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPathRulesCheckCollisions(t *testing.T) {
+	cases := []struct {
+		name    string
+		rules   pathRules
+		roots   []string
+		wantErr bool
+	}{
+		{
+			name:  "no_rules",
+			roots: []string{"/a", "/b"},
+		},
+		{
+			name:  "distinct",
+			rules: pathRules{{from: "/a", to: "/x"}},
+			roots: []string{"/a", "/b"},
+		},
+		{
+			name:    "same_target",
+			rules:   pathRules{{from: "/a", to: "/x"}, {from: "/b", to: "/x"}},
+			roots:   []string{"/a", "/b"},
+			wantErr: true,
+		},
+		{
+			name:    "target_within_other_root",
+			rules:   pathRules{{from: "/a", to: "/b/sub"}},
+			roots:   []string{"/a", "/b"},
+			wantErr: true,
+		},
+		{
+			name:    "strip_prefix_over_everything",
+			rules:   pathRules{{from: "/mnt/snap", to: "/"}},
+			roots:   []string{"/mnt/snap", "/home"},
+			wantErr: true,
+		},
+		{
+			name:  "overlapping_roots",
+			rules: pathRules{{from: "/a", to: "/x"}},
+			roots: []string{"/a", "/a/sub"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.rules.checkCollisions(tc.roots)
+			if tc.wantErr && err == nil {
+				t.Error("got no error, want one")
+			} else if !tc.wantErr && err != nil {
+				t.Errorf("got error %s, want none", err)
+			}
+		})
+	}
+}
+
+func TestPathRulesAddSymlink(t *testing.T) {
+	tmpdir := t.TempDir()
+	tmpdir, err := filepath.EvalSymlinks(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(tmpdir, "target")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(tmpdir, "link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+
+	var rules pathRules
+	if err := rules.Set(link + "=/data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rules.Set(filepath.Join(tmpdir, "missing") + "=/gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := canonicalPath(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rules.apply(filepath.Join(root, "file")); got != "/data/file" {
+		t.Errorf("got %s, want /data/file", got)
+	}
+	if got := rules.apply(filepath.Join(tmpdir, "missing", "file")); got != "/gone/file" {
+		t.Errorf("got %s, want /gone/file", got)
+	}
+
+	if err := rules.Set(target + "=/other"); err == nil {
+		t.Error("got no error for a second rule for the same directory, want one")
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/seaweedfs/fuse"
+)
+
+// refreshLoop refreshes the tree every interval (if it is positive)
+// and whenever the process gets SIGHUP,
+// until the context is canceled.
+func (f *FS) refreshLoop(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+		}
+		if err := f.refresh(ctx); err != nil {
+			log.Printf("Refreshing file system: %s", err)
+		}
+	}
+}
+
+// invalidation is a change to the tree that the kernel must be told about.
+type invalidation struct {
+	dir  *FSNode
+	name string // "" means the directory itself
+}
+
+// refresh brings the tree up to date with its source:
+// a new scan of the bucket,
+// a new read of the list file,
+// or (for an index) a new query for each directory loaded so far.
+// Nodes whose content has changed are replaced rather than updated,
+// so open files keep reading the version they opened.
+func (f *FS) refresh(ctx context.Context) error {
+	if err := f.wait(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+
+	var (
+		changes []invalidation
+		err     error
+	)
+	if f.idx != nil {
+		changes, err = f.refreshFromIndex(ctx)
+	} else {
+		changes, err = f.refreshFromTree(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	f.clearHashes()
+
+	// Notify the kernel only after releasing the lock,
+	// since it may make requests of its own in response.
+	if f.server != nil {
+		for _, c := range changes {
+			if c.name == "" {
+				err = f.server.InvalidateNodeData(c.dir)
+			} else {
+				err = f.server.InvalidateEntry(c.dir, c.name)
+			}
+			if err != nil && !errors.Is(err, fuse.ErrNotCached) {
+				log.Printf("Invalidating %s: %s", joinTreePath(c.dir.path, c.name), err)
+			}
+		}
+	}
+
+	log.Printf("Refreshed file system in %s, %d change(s)", time.Since(start), len(changes))
+	return nil
+}
+
+func (f *FS) refreshFromTree(ctx context.Context) ([]invalidation, error) {
+	if f.from == "-" {
+		return nil, fmt.Errorf("cannot refresh from standard input")
+	}
+
+	fresh := &FS{bucket: f.bucket, objects: f.objects, conf: f.conf, inodes: make(map[uint64]inodeKey), hosts: make(map[string]bool)}
+	fresh.root = fresh.newRoot()
+	if err := fresh.build(ctx, f.from); err != nil {
+		return nil, err
+	}
+
+	if f.rw != nil {
+		// Don't merge in the middle of a rename or remove.
+		f.rw.metaMu.Lock()
+		defer f.rw.metaMu.Unlock()
+	}
+
+	f.treeMu.Lock()
+	defer f.treeMu.Unlock()
+
+	var changes []invalidation
+	f.merge(f.root, fresh.root, &changes)
+	f.root.setDirStats()
+	f.hosts = fresh.hosts
+	f.pruneInodes()
+	return changes, nil
+}
+
+func (f *FS) refreshFromIndex(ctx context.Context) ([]invalidation, error) {
+	// The index may have been replaced since it was opened
+	// (list -db writes a new file and renames it into place),
+	// so open it again.
+	idx, err := openIndex(f.from)
+	if err != nil {
+		return nil, err
+	}
+
+	f.treeMu.Lock()
+	defer f.treeMu.Unlock()
+
+	old := f.idx
+	f.idx = idx
+	defer old.Close()
+
+	var changes []invalidation
+	if err := f.mergeFromIndex(ctx, f.root, &changes); err != nil {
+		return nil, err
+	}
+	f.pruneInodes()
+	return changes, nil
+}
+
+// mergeFromIndex updates the loaded directory dir, and its loaded subdirectories,
+// from the index.
+// The caller must hold f.treeMu.
+func (f *FS) mergeFromIndex(ctx context.Context, dir *FSNode, changes *[]invalidation) error {
+	dir.statLoaded = false
+
+	if !dir.loaded {
+		// This will be loaded from the new index when it is needed.
+		return nil
+	}
+
+	fresh := &FSNode{fs: f, path: dir.path, children: make(map[string]*FSNode)}
+	if err := fresh.loadFromIndex(ctx, f.idx); err != nil {
+		return err
+	}
+	for name, child := range fresh.children {
+		child.parent = dir
+		if old, ok := dir.children[name]; ok && old.isDir() && child.isDir() {
+			if err := f.mergeFromIndex(ctx, old, changes); err != nil {
+				return err
+			}
+			fresh.children[name] = old
+		}
+	}
+	f.mergeChildren(dir, fresh.children, changes)
+	return nil
+}
+
+// merge updates the directory dir to match fresh,
+// the corresponding directory in a newly built tree.
+// Files still being written through the file system,
+// and directories containing nothing else,
+// are kept.
+// The caller must hold f.treeMu.
+func (f *FS) merge(dir, fresh *FSNode, changes *[]invalidation) {
+	for name, old := range dir.children {
+		if !old.isLocal() {
+			continue
+		}
+		if child, ok := fresh.children[name]; ok && child.isDir() && old.isDir() {
+			continue
+		}
+		fresh.children[name] = old
+	}
+	for name, child := range fresh.children {
+		old, ok := dir.children[name]
+		switch {
+		case ok && child == old:
+			continue
+		case ok && old.isDir() && child.isDir():
+			f.merge(old, child, changes)
+			fresh.children[name] = old
+		case ok && sameFile(old, child):
+			fresh.children[name] = old
+		default:
+			f.adopt(dir, child)
+		}
+	}
+	f.mergeChildren(dir, fresh.children, changes)
+}
+
+// mergeChildren replaces the children of dir with fresh,
+// keeping the existing nodes for files that have not changed,
+// and records the changes.
+// The caller must hold f.treeMu.
+func (f *FS) mergeChildren(dir *FSNode, fresh map[string]*FSNode, changes *[]invalidation) {
+	var changed bool
+	for name, old := range dir.children {
+		child, ok := fresh[name]
+		switch {
+		case !ok:
+			// Removed.
+		case child == old:
+			continue
+		case sameFile(old, child):
+			// Unchanged.
+			fresh[name] = old
+			continue
+		}
+		*changes = append(*changes, invalidation{dir: dir, name: name})
+		changed = true
+	}
+	for name := range fresh {
+		if _, ok := dir.children[name]; !ok {
+			// Added. The kernel may have cached its absence.
+			*changes = append(*changes, invalidation{dir: dir, name: name})
+			changed = true
+		}
+	}
+	if changed {
+		*changes = append(*changes, invalidation{dir: dir})
+	}
+	dir.children = fresh
+}
+
+// isLocal tells whether the node n exists only in this file system, not in the bucket:
+// a file whose content is staged (see rw.go),
+// or a directory containing nothing but such files and directories.
+// The caller must hold n.fs.treeMu.
+func (n *FSNode) isLocal() bool {
+	if !n.isDir() {
+		return n.stage != nil
+	}
+	for _, child := range n.children {
+		if !child.isLocal() {
+			return false
+		}
+	}
+	return true
+}
+
+// sameFile tells whether a and b are the same version of the same file.
+func sameFile(a, b *FSNode) bool {
+	return !a.isDir() && !b.isDir() && a.hash == b.hash && a.timestamp.Equal(b.timestamp)
+}
+
+// adopt moves node, from a newly built tree, into this one as a child of dir.
+func (f *FS) adopt(dir, node *FSNode) {
+	node.parent = dir
+	var walk func(*FSNode)
+	walk = func(n *FSNode) {
+		n.fs = f
+		n.inode = f.inodeFor(n.path, n.hash)
+		for _, child := range n.children {
+			walk(child)
+		}
+	}
+	walk(node)
+}
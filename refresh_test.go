@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRefreshPrunesInodes(t *testing.T) {
+	ctx := context.Background()
+	listfile := filepath.Join(t.TempDir(), "list.json")
+
+	t0 := time.Unix(1700000000, 0)
+	writeList := func(gen int) {
+		t.Helper()
+		err := writeListFile(listfile, func(write func(listType) error) error {
+			// One file that never changes, and a directory of files that are all replaced each time.
+			if err := write(listType{Hash: "sha256-keep", Size: 1, Paths: map[string]time.Time{"host:/keep": t0}}); err != nil {
+				return err
+			}
+			for i := 0; i < 10; i++ {
+				l := listType{
+					Hash:  fmt.Sprintf("sha256-%d-%d", gen, i),
+					Size:  1,
+					Paths: map[string]time.Time{fmt.Sprintf("host:/gen%d/file%d", gen, i): t0},
+				}
+				if err := write(l); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeList(0)
+	f, err := newFS(ctx, nil, retryConf{}, listfile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	keep, err := f.root.findNode("host/keep", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keepInode := keep.inode
+
+	// host, keep, gen0, and the files in it.
+	const want = 13
+
+	for gen := 1; gen <= 5; gen++ {
+		writeList(gen)
+		if err := f.refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		f.mu.Lock()
+		got := len(f.inodes)
+		f.mu.Unlock()
+		if got != want {
+			t.Errorf("after refresh %d, got %d inodes, want %d", gen, got, want)
+		}
+
+		keep, err := f.root.findNode("host/keep", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keep.inode != keepInode {
+			t.Errorf("after refresh %d, inode of unchanged file changed from %d to %d", gen, keepInode, keep.inode)
+		}
+	}
+}
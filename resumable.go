@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// defaultResumableSize is the default size at or above which
+	// files are uploaded in resumable parts.
+	defaultResumableSize = 256 << 20
+
+	// partSize is the size of each part of a resumable upload
+	// (except the last, which may be smaller).
+	partSize = 64 << 20
+
+	// maxComposeSources is the most objects GCS will compose in a single request.
+	maxComposeSources = 32
+
+	// defaultTmpMaxAge is the default age at which save deletes temporary objects
+	// left behind by uploads that crashed or were interrupted.
+	// It is long enough for the parts of an interrupted resumable upload
+	// to survive until a later run resumes it.
+	defaultTmpMaxAge = 7 * 24 * time.Hour
+)
+
+// resumeState is the locally persisted state of a resumable upload.
+// It is stored in a JSON file named for the object being uploaded.
+// Since object names are content hashes,
+// the parts already uploaded remain valid for any file with the same hash.
+type resumeState struct {
+	Size     int64    `json:"size"`
+	PartSize int64    `json:"part_size"`
+	Parts    []uint32 `json:"parts"` // CRC32C of each completed part, in order
+}
+
+func defaultStateDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gcsbackup"), nil
+}
+
+func (s *saver) resumeStateFile(name string) string {
+	return filepath.Join(s.stateDir, "uploads", name+".json")
+}
+
+func partName(name string, n int) string {
+	return fmt.Sprintf("%s%s-part-%05d", tmpPrefix, name, n)
+}
+
+// uploadResumable uploads a file to obj as a series of parts,
+// which are then composed into a single object.
+// Progress is recorded locally after each part,
+// so that an interrupted upload can resume on a later run
+// after checking that the parts already in the bucket are intact.
+// The composed object's CRC32C must match u.crc.
+func (s *saver) uploadResumable(ctx context.Context, obj *storage.ObjectHandle, u *upload) error {
+	var (
+		size      = u.state.size
+		nparts    = int((size + partSize - 1) / partSize)
+		stateFile = s.resumeStateFile(u.name)
+		rs        = s.loadResumeState(ctx, stateFile, u)
+	)
+
+	if len(rs.Parts) > 0 {
+		log.Printf("Resuming upload of %s at part %d of %d", u.path, len(rs.Parts)+1, nparts)
+	}
+
+	err := readFile(u.localPath, u.restoreTimes, func(r io.ReadSeeker) error {
+		for n := len(rs.Parts); n < nparts; n++ {
+			var (
+				offset = int64(n) * partSize
+				length = int64(partSize)
+			)
+			if offset+length > size {
+				length = size - offset
+			}
+
+			log.Printf("Uploading part %d of %d of %s", n+1, nparts, u.path)
+
+			var partCRC uint32
+			err := withRetries(s.bkoff, func() error {
+				if _, err := r.Seek(offset, io.SeekStart); err != nil {
+					return backoff.Permanent(errors.Wrapf(err, "seeking to part %d of %s", n+1, u.path))
+				}
+
+				uw := s.objects.NewWriter(ctx, partName(u.name, n), 0, false)
+
+				var w io.WriteCloser = uw
+				if s.limiter != nil {
+					w = &limitingWriter{ctx: ctx, limiter: s.limiter, w: w}
+				}
+
+				crcHasher := crc32.New(crc32cTable)
+				if _, err := io.Copy(w, io.TeeReader(io.LimitReader(r, length), crcHasher)); err != nil {
+					return errors.Wrapf(err, "uploading part %d of %s", n+1, u.path)
+				}
+				if err := w.Close(); err != nil {
+					return errors.Wrapf(err, "closing upload channel for part %d of %s", n+1, u.path)
+				}
+				partCRC = crcHasher.Sum32()
+				if got := uw.CRC32C(); got != partCRC {
+					return errors.Wrapf(errChecksumMismatch, "uploading part %d of %s: got CRC32C %08x, want %08x", n+1, u.path, got, partCRC)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			if changed, err := u.state.changed(u.localPath); err != nil {
+				return errors.Wrapf(err, "checking %s for changes", u.path)
+			} else if changed {
+				return errFileChanged
+			}
+
+			rs.Parts = append(rs.Parts, partCRC)
+			if err := saveResumeState(stateFile, rs); err != nil {
+				return errors.Wrapf(err, "saving upload state for %s", u.path)
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errFileChanged) {
+		s.discardResumable(ctx, u.name, nparts)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	var parts []*storage.ObjectHandle
+	for n := 0; n < nparts; n++ {
+		parts = append(parts, s.bucket.Object(partName(u.name, n)))
+	}
+
+	attrs, err := s.compose(ctx, obj, parts, u.name)
+	if err != nil {
+		return errors.Wrapf(err, "composing parts of %s", u.path)
+	}
+	if attrs.CRC32C != u.crc {
+		// Each part was checked against the content read for it,
+		// so the composed object differs from the content that was hashed
+		// only if the file changed in between
+		// (which its times may not show, if they were restored by readFile).
+		// Start over next time.
+		s.discardResumable(ctx, u.name, nparts)
+		return errFileChanged
+	}
+
+	s.discardResumable(ctx, u.name, nparts)
+	return nil
+}
+
+// loadResumeState loads the state of an earlier, interrupted upload.
+// Only the parts that are still present and intact in the bucket are kept.
+// If there is no usable earlier state,
+// the result describes an upload that has not started.
+func (s *saver) loadResumeState(ctx context.Context, stateFile string, u *upload) *resumeState {
+	fresh := &resumeState{Size: u.state.size, PartSize: partSize}
+
+	f, err := os.Open(stateFile)
+	if err != nil {
+		return fresh
+	}
+	defer f.Close()
+
+	var rs resumeState
+	if err := json.NewDecoder(f).Decode(&rs); err != nil {
+		log.Printf("Ignoring unreadable upload state in %s: %s", stateFile, err)
+		return fresh
+	}
+	if rs.Size != u.state.size || rs.PartSize != partSize {
+		return fresh
+	}
+
+	for n, crc := range rs.Parts {
+		attrs, err := s.bucket.Object(partName(u.name, n)).Attrs(ctx)
+		if err != nil || attrs.CRC32C != crc {
+			rs.Parts = rs.Parts[:n]
+			break
+		}
+	}
+	return &rs
+}
+
+func saveResumeState(stateFile string, rs *resumeState) error {
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0700); err != nil {
+		return err
+	}
+	j, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+	tmpfile := stateFile + ".tmp"
+	if err := os.WriteFile(tmpfile, j, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, stateFile)
+}
+
+// discardResumable removes the local state and uploaded parts of a resumable upload.
+// Errors are logged but otherwise ignored.
+func (s *saver) discardResumable(ctx context.Context, name string, nparts int) {
+	if err := os.Remove(s.resumeStateFile(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Error removing upload state for %s: %s", name, err)
+	}
+	for n := 0; n < nparts; n++ {
+		s.deleteTmp(ctx, s.bucket.Object(partName(name, n)))
+	}
+}
+
+// compose composes srcs into dst.
+// GCS limits the number of sources in a single compose request,
+// so larger numbers of srcs are composed in rounds
+// via intermediate temporary objects.
+func (s *saver) compose(ctx context.Context, dst *storage.ObjectHandle, srcs []*storage.ObjectHandle, name string) (*storage.ObjectAttrs, error) {
+	for round := 0; len(srcs) > maxComposeSources; round++ {
+		var next []*storage.ObjectHandle
+		for i := 0; i < len(srcs); i += maxComposeSources {
+			end := i + maxComposeSources
+			if end > len(srcs) {
+				end = len(srcs)
+			}
+			intermediate := s.bucket.Object(fmt.Sprintf("%s%s-compose-%d-%d", tmpPrefix, name, round, i/maxComposeSources))
+			defer s.deleteTmp(ctx, intermediate)
+
+			err := withRetries(s.bkoff, func() error {
+				_, err := intermediate.ComposerFrom(srcs[i:end]...).Run(ctx)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, intermediate)
+		}
+		srcs = next
+	}
+
+	var attrs *storage.ObjectAttrs
+	err := withRetries(s.bkoff, func() error {
+		var err error
+		attrs, err = dst.ComposerFrom(srcs...).Run(ctx)
+		return err
+	})
+	return attrs, err
+}
+
+// deleteTmp deletes a temporary object.
+// Errors are logged but otherwise ignored.
+func (s *saver) deleteTmp(ctx context.Context, obj *storage.ObjectHandle) {
+	err := withRetries(s.bkoff, func() error {
+		err := obj.Delete(ctx)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		log.Printf("Error deleting temporary object %s: %s", obj.ObjectName(), err)
+	}
+}
+
+// sweepTmp deletes temporary objects last updated more than maxAge ago.
+// These are left behind by uploads that crashed or were interrupted
+// and were never resumed.
+func (s *saver) sweepTmp(ctx context.Context, maxAge time.Duration) error {
+	var (
+		cutoff = time.Now().Add(-maxAge)
+		stale  []string
+	)
+	err := withRetries(s.bkoff, func() error {
+		stale = nil
+
+		query := &storage.Query{Prefix: tmpPrefix, Projection: storage.ProjectionNoACL}
+		if err := query.SetAttrSelection([]string{"Name", "Updated"}); err != nil {
+			return backoff.Permanent(err)
+		}
+		it := s.bucket.Objects(ctx, query)
+		for {
+			attrs, err := it.Next()
+			if errors.Is(err, iterator.Done) {
+				return nil
+			}
+			if err != nil {
+				return errors.Wrap(err, "iterating through temporary objects")
+			}
+			if attrs.Updated.Before(cutoff) {
+				stale = append(stale, attrs.Name)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(stale) > 0 {
+		log.Printf("Deleting %d temporary object(s) older than %s", len(stale), maxAge)
+	}
+	for _, name := range stale {
+		s.deleteTmp(ctx, s.bucket.Object(name))
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+// retryConf is the policy for retrying failed GCS operations.
+// It can be set with command-line flags,
+// and in the config file for the fs subcommand.
+type retryConf struct {
+	Retries uint64        `yaml:"retries"` // how many times to retry a failed operation
+	Initial time.Duration `yaml:"initial"` // the interval before the first retry
+	Max     time.Duration `yaml:"max"`     // the longest interval between retries
+}
+
+const (
+	defaultRetries      = 3
+	defaultRetryInitial = 10 * time.Second
+	defaultRetryMax     = time.Minute
+)
+
+// newBackoff produces a new backoff.BackOff according to the retry policy.
+// A BackOff is not safe for concurrent use,
+// so concurrent operations must each get their own.
+func (rc retryConf) newBackoff(ctx context.Context) backoff.BackOff {
+	expBkoff := backoff.NewExponentialBackOff()
+	expBkoff.InitialInterval = rc.Initial
+	if rc.Max > 0 {
+		expBkoff.MaxInterval = rc.Max
+	}
+	bkoff := backoff.WithMaxRetries(expBkoff, rc.Retries)
+	return backoff.WithContext(bkoff, ctx)
+}
+
+// withRetries calls f until it succeeds,
+// the backoff policy gives up,
+// or f returns an error that isRetryable says is permanent.
+func withRetries(bkoff backoff.BackOff, f func() error) error {
+	bkoff.Reset()
+	return backoff.Retry(func() error { // The backoff API gets the order of these arguments wrong.
+		err := f()
+		if err != nil && !isRetryable(err) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}, bkoff)
+}
+
+// isRetryable tells whether err is likely to be transient,
+// such as a network error or an HTTP 429 or 5xx response,
+// as opposed to a permanent one,
+// such as an HTTP 4xx response or an error from the local filesystem.
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var permanent *backoff.PermanentError
+	if errors.As(err, &permanent) {
+		return false
+	}
+
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.Is(err, storage.ErrObjectNotExist), errors.Is(err, storage.ErrBucketNotExist):
+		return false
+	case errors.Is(err, errChecksumMismatch):
+		return true
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == 408 || apiErr.Code == 429 || (apiErr.Code >= 500 && apiErr.Code < 600)
+	}
+
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return storage.ShouldRetry(err)
+}
+
+// isPreconditionFailed tells whether err is an HTTP 412 response,
+// meaning the object did not meet the conditions given for an operation on it.
+func isPreconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == 412
+}
@@ -0,0 +1,804 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/seaweedfs/fuse"
+	"github.com/seaweedfs/fuse/fs"
+)
+
+// A file system served with fs -rw is writable.
+// A file that is created or opened for writing
+// has its content kept in a local staging directory,
+// and is saved to the bucket as save would save it
+// (in an object named for the hash of its content,
+// with its path added to the object's paths metadata)
+// when it is synced, or when the last handle to it is released.
+// After that it is read from its object again.
+//
+// Renaming or removing a file changes its object's paths metadata.
+// Objects are never deleted.
+//
+// There are no directories in the bucket apart from the files in them,
+// so an empty directory lasts only until the file system is unmounted.
+
+var (
+	_ fs.NodeCreater    = &FSNode{}
+	_ fs.NodeMkdirer    = &FSNode{}
+	_ fs.NodeRemover    = &FSNode{}
+	_ fs.NodeRenamer    = &FSNode{}
+	_ fs.NodeSetattrer  = &FSNode{}
+	_ fs.NodeFsyncer    = &FSNode{}
+	_ fs.HandleReader   = &stageHandle{}
+	_ fs.HandleWriter   = &stageHandle{}
+	_ fs.HandleReleaser = &stageHandle{}
+)
+
+// rwState is the state of a writable file system.
+//
+// Locks are taken in this order:
+// a stagedFile's mu, then metaMu, then the FS's treeMu.
+type rwState struct {
+	c        maincmd // for saving files and fetching their content
+	stageDir string
+	tmpStage bool   // whether stageDir was created for this mount, and is to be removed afterward
+	stateDir string // for resumable uploads (see saver)
+
+	// metaMu serializes changes to paths metadata,
+	// and to the nodes recording them.
+	metaMu sync.Mutex
+
+	mu     sync.Mutex // protects stages
+	stages map[*stagedFile]*FSNode
+}
+
+func newRWState(c maincmd, stageDir string) (*rwState, error) {
+	stateDir, err := defaultStateDir()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting default state dir")
+	}
+
+	rw := &rwState{
+		c:        c,
+		stageDir: stageDir,
+		stateDir: stateDir,
+		stages:   make(map[*stagedFile]*FSNode),
+	}
+	if stageDir == "" {
+		if rw.stageDir, err = os.MkdirTemp("", "gcsbackup-stage-"); err != nil {
+			return nil, errors.Wrap(err, "creating staging dir")
+		}
+		rw.tmpStage = true
+	} else if err := os.MkdirAll(stageDir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "creating staging dir %s", stageDir)
+	}
+	return rw, nil
+}
+
+// finishRW saves any files whose staged content has not been saved,
+// after the file system is unmounted.
+func (f *FS) finishRW(ctx context.Context) {
+	f.rw.mu.Lock()
+	pending := make(map[*stagedFile]*FSNode, len(f.rw.stages))
+	for st, n := range f.rw.stages {
+		pending[st] = n
+	}
+	f.rw.mu.Unlock()
+
+	var unsaved int
+	for st, n := range pending {
+		if err := n.save(ctx, st); err != nil {
+			log.Printf("Saving %s: %s", st.file.Name(), err)
+			unsaved++
+			continue
+		}
+		f.rw.discard(st)
+	}
+	if unsaved > 0 {
+		log.Printf("Left %d unsaved file(s) in %s", unsaved, f.rw.stageDir)
+		return
+	}
+	if f.rw.tmpStage {
+		if err := os.Remove(f.rw.stageDir); err != nil {
+			log.Printf("Removing staging dir: %s", err)
+		}
+	}
+}
+
+// stagedFile holds the content of a file being written.
+type stagedFile struct {
+	mu    sync.Mutex // protects dirty, and the content of file
+	file  *os.File
+	dirty bool // whether the content has changed since it was last saved
+
+	// The result of the last save, protected by rwState.metaMu.
+	name  string    // the object's name, or "" if the content has not been saved
+	key   string    // where it is recorded in the object's paths metadata
+	saved time.Time // the time recorded there, or zero if it was already recorded by an earlier version
+}
+
+func (rw *rwState) newStage() (*stagedFile, error) {
+	file, err := os.CreateTemp(rw.stageDir, "file-")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating staged file")
+	}
+	return &stagedFile{file: file}, nil
+}
+
+// track records that st holds the content of n,
+// so that it can be saved when the file system is unmounted if it hasn't been already.
+func (rw *rwState) track(st *stagedFile, n *FSNode) {
+	rw.mu.Lock()
+	rw.stages[st] = n
+	rw.mu.Unlock()
+}
+
+// discard removes the staged content st.
+func (rw *rwState) discard(st *stagedFile) {
+	rw.mu.Lock()
+	delete(rw.stages, st)
+	rw.mu.Unlock()
+
+	st.file.Close()
+	if err := os.Remove(st.file.Name()); err != nil {
+		log.Printf("Removing staged file: %s", err)
+	}
+}
+
+// attr sets the size and modification time in a from the staged content.
+func (st *stagedFile) attr(a *fuse.Attr) {
+	if info, err := st.file.Stat(); err == nil {
+		a.Size = uint64(info.Size())
+		a.Mtime = info.ModTime()
+	}
+}
+
+func (st *stagedFile) truncate(size int64) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.dirty = true
+	return errors.Wrap(st.file.Truncate(size), "truncating staged file")
+}
+
+// openRW opens the file n in a writable file system.
+// Every open handle counts toward n.opens,
+// since n's object cannot change while any of them is reading it.
+func (n *FSNode) openRW(ctx context.Context, req *fuse.OpenRequest) (fs.Handle, error) {
+	if n.virtual {
+		if !req.Flags.IsReadOnly() {
+			return nil, syscall.EROFS
+		}
+		return &fileHandle{n: n, cached: -1}, nil
+	}
+	if !req.Flags.IsReadOnly() {
+		st, err := n.openStage(ctx, req.Flags&fuse.OpenTruncate != 0)
+		if err != nil {
+			return nil, err
+		}
+		return &stageHandle{n: n, st: st}, nil
+	}
+
+	n.fs.treeMu.Lock()
+	n.opens++
+	st := n.stage
+	n.fs.treeMu.Unlock()
+
+	if st != nil {
+		return &stageHandle{n: n, st: st}, nil
+	}
+	return &fileHandle{n: n, cached: -1}, nil
+}
+
+// openStage opens the file n for writing,
+// first copying its content to the staging directory
+// unless it is already there or trunc is true.
+func (n *FSNode) openStage(ctx context.Context, trunc bool) (*stagedFile, error) {
+	n.fs.treeMu.Lock()
+	n.opens++
+	st, hash := n.stage, n.hash
+	n.fs.treeMu.Unlock()
+
+	if st == nil {
+		fresh, err := n.fs.rw.newStage()
+		if err == nil && !trunc {
+			err = n.fs.rw.c.copyObject(ctx, fresh.file, hash, 0, -1)
+			if err != nil {
+				n.fs.rw.discard(fresh)
+			}
+		}
+		if err != nil {
+			n.fs.treeMu.Lock()
+			n.opens--
+			n.fs.treeMu.Unlock()
+			return nil, err
+		}
+
+		n.fs.treeMu.Lock()
+		if n.stage == nil {
+			n.stage = fresh
+			n.fs.rw.track(fresh, n)
+		}
+		st = n.stage
+		n.fs.treeMu.Unlock()
+
+		if st != fresh {
+			// Another open got there first.
+			n.fs.rw.discard(fresh)
+		}
+	}
+
+	if trunc {
+		if err := st.truncate(0); err != nil {
+			n.release(ctx)
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// release is called when a handle to the file n is released in a writable file system.
+// When the last one is, any staged content is saved,
+// and n goes back to being read from its object.
+func (n *FSNode) release(ctx context.Context) error {
+	n.fs.treeMu.Lock()
+	n.opens--
+	last := n.opens == 0
+	st := n.stage
+	n.fs.treeMu.Unlock()
+
+	if !last || st == nil {
+		return nil
+	}
+	if err := n.save(ctx, st); err != nil {
+		// The content stays staged,
+		// and saving it is tried again the next time n is released or synced,
+		// or when the file system is unmounted.
+		log.Printf("Saving %s: %s", st.file.Name(), err)
+		return err
+	}
+	n.settle(st)
+	return nil
+}
+
+// save saves the staged content of the file n,
+// if it has changed since it was last saved.
+func (n *FSNode) save(ctx context.Context, st *stagedFile) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if !st.dirty {
+		return nil
+	}
+
+	n.fs.treeMu.RLock()
+	var (
+		removed         = n.parent == nil
+		path, key, prev = n.path, n.key, n.hash
+	)
+	if key == "" {
+		key = n.fs.keyFor(path)
+	}
+	n.fs.treeMu.RUnlock()
+
+	if removed {
+		return nil
+	}
+
+	info, err := st.file.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "statting staged content of %s", path)
+	}
+	// Unlike save, this saves empty files:
+	// an empty file here was created or truncated on purpose,
+	// and not saving it would lose that.
+
+	s := &saver{
+		maincmd:       n.fs.rw.c,
+		bkoff:         n.fs.conf.Retry.newBackoff(ctx),
+		resumableSize: defaultResumableSize,
+		stateDir:      n.fs.rw.stateDir,
+		objects:       bucketWriter{bucket: n.fs.bucket},
+	}
+	name, saved, err := s.saveAs(ctx, st.file.Name(), path, key, prev, info, false)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		// This can't happen while st.mu is held.
+		return fmt.Errorf("%s changed while being saved", path)
+	}
+
+	n.fs.rw.metaMu.Lock()
+	defer n.fs.rw.metaMu.Unlock()
+
+	// The file may have been renamed or removed while it was being saved.
+	n.fs.treeMu.RLock()
+	removed = n.parent == nil
+	cur := n.key
+	if cur == "" {
+		cur = n.fs.keyFor(n.path)
+	}
+	n.fs.treeMu.RUnlock()
+
+	switch {
+	case removed:
+		err = n.fs.editPaths(ctx, name, func(paths map[string]int64) {
+			delete(paths, key)
+		})
+	case cur != key:
+		now := time.Now().Unix()
+		err = n.fs.editPaths(ctx, name, func(paths map[string]int64) {
+			delete(paths, key)
+			paths[cur] = now
+		})
+		saved = time.Unix(now, 0)
+	}
+	if err != nil {
+		return err
+	}
+
+	st.name, st.key, st.saved = name, cur, saved
+	st.dirty = false
+	return nil
+}
+
+// settle discards the staged content of n once it is no longer needed:
+// when n has been removed,
+// or when the content has been saved and n has no open handles,
+// in which case n goes back to being read from its object.
+func (n *FSNode) settle(st *stagedFile) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	n.fs.rw.metaMu.Lock()
+	defer n.fs.rw.metaMu.Unlock()
+
+	n.fs.treeMu.Lock()
+	switch {
+	case n.stage != st:
+		// Already settled.
+		n.fs.treeMu.Unlock()
+		return
+	case n.parent == nil:
+		// Removed.
+	case n.opens > 0 || st.dirty:
+		n.fs.treeMu.Unlock()
+		return
+	case st.name != "":
+		n.hash, n.key = st.name, st.key
+		if !st.saved.IsZero() {
+			n.timestamp = st.saved
+		}
+		if info, err := st.file.Stat(); err == nil {
+			n.size = uint64(info.Size())
+		}
+	}
+	n.stage = nil
+	n.fs.treeMu.Unlock()
+
+	n.fs.rw.discard(st)
+	n.fs.clearHashes()
+}
+
+// stageHandle reads and writes the staged content of a file.
+type stageHandle struct {
+	n  *FSNode
+	st *stagedFile
+}
+
+func (h *stageHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.st.mu.Lock()
+	defer h.st.mu.Unlock()
+
+	buf := make([]byte, req.Size)
+	nbytes, err := h.st.file.ReadAt(buf, req.Offset)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	resp.Data = buf[:nbytes]
+	return err
+}
+
+func (h *stageHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	h.st.mu.Lock()
+	defer h.st.mu.Unlock()
+
+	h.st.dirty = true
+	nbytes, err := h.st.file.WriteAt(req.Data, req.Offset)
+	resp.Size = nbytes
+	return err
+}
+
+func (h *stageHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return h.n.release(ctx)
+}
+
+func (n *FSNode) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	n.fs.treeMu.RLock()
+	st := n.stage
+	n.fs.treeMu.RUnlock()
+
+	if st == nil {
+		return nil
+	}
+	return n.save(ctx, st)
+}
+
+// Setattr handles changes to the size of a file.
+// Other changes (to its mode, ownership, or times) are ignored.
+func (n *FSNode) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Size() {
+		if n.fs.rw == nil || n.virtual {
+			return syscall.EROFS
+		}
+		if n.isDir() {
+			return syscall.EISDIR
+		}
+		st, err := n.openStage(ctx, req.Size == 0)
+		if err != nil {
+			return err
+		}
+		err = st.truncate(int64(req.Size))
+		if releaseErr := n.release(ctx); err == nil {
+			err = releaseErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return n.Attr(ctx, &resp.Attr)
+}
+
+func (n *FSNode) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	if n.fs.rw == nil {
+		return nil, nil, syscall.EROFS
+	}
+	if n.isVirtual(req.Name) {
+		return nil, nil, syscall.EEXIST
+	}
+	if err := n.load(); err != nil {
+		return nil, nil, err
+	}
+
+	st, err := n.fs.rw.newStage()
+	if err != nil {
+		return nil, nil, err
+	}
+	st.dirty = true
+
+	n.fs.treeMu.Lock()
+	defer n.fs.treeMu.Unlock()
+
+	if _, ok := n.children[req.Name]; ok {
+		n.fs.rw.discard(st)
+		return nil, nil, syscall.EEXIST
+	}
+
+	path := joinTreePath(n.path, req.Name)
+	child := &FSNode{
+		fs:        n.fs,
+		inode:     n.fs.inodeFor(path, ""),
+		parent:    n,
+		path:      path,
+		timestamp: time.Now(),
+		stage:     st,
+		opens:     1,
+	}
+	n.children[req.Name] = child
+	n.fs.rw.track(st, child)
+
+	return child, &stageHandle{n: child, st: st}, nil
+}
+
+func (n *FSNode) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	if n.fs.rw == nil {
+		return nil, syscall.EROFS
+	}
+	if n.isVirtual(req.Name) {
+		return nil, syscall.EEXIST
+	}
+	if err := n.load(); err != nil {
+		return nil, err
+	}
+
+	n.fs.treeMu.Lock()
+	defer n.fs.treeMu.Unlock()
+
+	if _, ok := n.children[req.Name]; ok {
+		return nil, syscall.EEXIST
+	}
+	child := n.newDir(req.Name)
+	child.nlink = 2
+	n.children[req.Name] = child
+	n.nlink++
+	return child, nil
+}
+
+func (n *FSNode) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if n.fs.rw == nil {
+		return syscall.EROFS
+	}
+	if n.isVirtual(req.Name) {
+		return syscall.EPERM
+	}
+	if err := n.load(); err != nil {
+		return err
+	}
+
+	n.fs.rw.metaMu.Lock()
+	defer n.fs.rw.metaMu.Unlock()
+
+	n.fs.treeMu.RLock()
+	child, recs, err := n.planRemove(req.Name, req.Dir)
+	n.fs.treeMu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range recs {
+		err := n.fs.editPaths(ctx, rec.hash, func(paths map[string]int64) {
+			delete(paths, rec.key)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	n.fs.treeMu.Lock()
+	if n.children[req.Name] == child {
+		n.detach(req.Name)
+	}
+	st := child.stage
+	n.fs.treeMu.Unlock()
+
+	if st != nil {
+		// This waits for any save in progress,
+		// so it can't be done while holding metaMu.
+		go child.settle(st)
+	}
+	n.fs.clearHashes()
+	return nil
+}
+
+func (n *FSNode) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if n.fs.rw == nil {
+		return syscall.EROFS
+	}
+	to, ok := newDir.(*FSNode)
+	if !ok {
+		return syscall.EXDEV
+	}
+	if n.isVirtual(req.OldName) || to.isVirtual(req.NewName) {
+		return syscall.EPERM
+	}
+	if err := n.load(); err != nil {
+		return err
+	}
+	if err := to.load(); err != nil {
+		return err
+	}
+
+	n.fs.rw.metaMu.Lock()
+	defer n.fs.rw.metaMu.Unlock()
+
+	now := time.Now().Unix()
+
+	n.fs.treeMu.RLock()
+	node, moves, err := n.planRename(req.OldName, to, req.NewName)
+	n.fs.treeMu.RUnlock()
+	if err != nil || node == nil {
+		return err
+	}
+
+	for _, m := range moves {
+		for _, rec := range m.recs {
+			newKey := m.newKey
+			err := n.fs.editPaths(ctx, rec.hash, func(paths map[string]int64) {
+				delete(paths, rec.key)
+				paths[newKey] = now
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	n.fs.treeMu.Lock()
+	defer n.fs.treeMu.Unlock()
+
+	if n.children[req.OldName] != node {
+		// Changed by a refresh in the meantime.
+		return syscall.EAGAIN
+	}
+	n.detach(req.OldName)
+	if target, ok := to.children[req.NewName]; ok {
+		to.detach(req.NewName)
+		if st := target.stage; st != nil {
+			go target.settle(st)
+		}
+	}
+	to.children[req.NewName] = node
+	node.parent = to
+	if node.isDir() {
+		to.nlink++
+	}
+	node.move(joinTreePath(to.path, req.NewName))
+
+	for _, m := range moves {
+		if m.node.key != "" {
+			m.node.key = m.newKey
+			m.node.timestamp = time.Unix(now, 0)
+		}
+		if st := m.node.stage; st != nil && st.name != "" {
+			st.key = m.newKey
+			st.saved = time.Unix(now, 0)
+		}
+	}
+
+	n.fs.clearHashes()
+	return nil
+}
+
+// planRemove checks that the child of n with the given name can be removed
+// (by rmdir if dir is true, otherwise by unlink),
+// and returns it along with its entries in paths metadata.
+// The caller must hold n.fs.treeMu and n.fs.rw.metaMu.
+func (n *FSNode) planRemove(name string, dir bool) (*FSNode, []record, error) {
+	child, ok := n.children[name]
+	switch {
+	case !ok:
+		return nil, nil, syscall.ENOENT
+	case dir && !child.isDir():
+		return nil, nil, syscall.ENOTDIR
+	case dir && len(child.children) > 0:
+		return nil, nil, syscall.ENOTEMPTY
+	case !dir && child.isDir():
+		return nil, nil, syscall.EISDIR
+	case dir:
+		return child, nil, nil
+	}
+	return child, child.records(), nil
+}
+
+// fileMove is the change to a file's records in paths metadata
+// when it is renamed.
+type fileMove struct {
+	node   *FSNode
+	recs   []record
+	newKey string
+}
+
+// planRename checks that the child of n called oldName can be renamed to newName in the directory to,
+// and returns it along with the changes to make to paths metadata.
+// It returns a nil node if there is nothing to do.
+// The caller must hold n.fs.treeMu and n.fs.rw.metaMu.
+func (n *FSNode) planRename(oldName string, to *FSNode, newName string) (*FSNode, []fileMove, error) {
+	node, ok := n.children[oldName]
+	if !ok {
+		return nil, nil, syscall.ENOENT
+	}
+	target, ok := to.children[newName]
+	if ok && target == node {
+		return nil, nil, nil
+	}
+	if node.isDir() {
+		for d := to; d != nil; d = d.parent {
+			if d == node {
+				// A directory can't be moved inside itself.
+				return nil, nil, syscall.EINVAL
+			}
+		}
+	}
+	if ok {
+		switch {
+		case target.isDir() && !node.isDir():
+			return nil, nil, syscall.EISDIR
+		case !target.isDir() && node.isDir():
+			return nil, nil, syscall.ENOTDIR
+		case target.isDir() && len(target.children) > 0:
+			return nil, nil, syscall.ENOTEMPTY
+		}
+	}
+
+	// The replaced file, if any, is not touched.
+	// It remains in its object's paths metadata,
+	// as an earlier version of the file at the new path.
+
+	var (
+		newPath = joinTreePath(to.path, newName)
+		moves   []fileMove
+		walk    func(*FSNode, string)
+	)
+	walk = func(x *FSNode, path string) {
+		if !x.isDir() {
+			moves = append(moves, fileMove{node: x, recs: x.records(), newKey: n.fs.keyFor(path)})
+			return
+		}
+		for name, child := range x.children {
+			walk(child, joinTreePath(path, name))
+		}
+	}
+	walk(node, newPath)
+	return node, moves, nil
+}
+
+// detach removes the child with the given name from the directory n.
+// The caller must hold n.fs.treeMu.
+func (n *FSNode) detach(name string) {
+	child := n.children[name]
+	delete(n.children, name)
+	child.parent = nil
+	if child.isDir() {
+		n.nlink--
+	}
+}
+
+// move gives n, and everything under it, new paths
+// (and inode numbers to go with them)
+// after it has been renamed to path.
+// The caller must hold n.fs.treeMu.
+func (n *FSNode) move(path string) {
+	n.path = path
+	n.inode = n.fs.inodeFor(path, n.hash)
+	for name, child := range n.children {
+		child.move(joinTreePath(path, name))
+	}
+}
+
+// record is an entry in an object's paths metadata.
+type record struct {
+	hash, key string
+}
+
+// records returns the entries in paths metadata for the file n:
+// the one for its object,
+// and the one for its staged content if that has been saved.
+// The caller must hold n.fs.treeMu and n.fs.rw.metaMu.
+func (n *FSNode) records() []record {
+	var recs []record
+	if n.key != "" {
+		recs = append(recs, record{hash: n.hash, key: n.key})
+	}
+	if st := n.stage; st != nil && st.name != "" && (st.name != n.hash || st.key != n.key) {
+		recs = append(recs, record{hash: st.name, key: st.key})
+	}
+	return recs
+}
+
+// keyFor returns the key for a new file at the given tree path.
+// If the first element of the path is a host namespace,
+// it has the form HOST:/PATH.
+// Otherwise it is /PATH.
+// Either way, treePath turns it back into the tree path.
+// The caller must hold f.treeMu.
+func (f *FS) keyFor(path string) string {
+	if host, rest, ok := strings.Cut(path, "/"); ok && f.hosts[host] {
+		return indexKey(host, "/"+rest)
+	}
+	return "/" + path
+}
+
+// editPaths changes the paths metadata of the object with the given name
+// (see updatePaths).
+// The caller must hold f.rw.metaMu.
+func (f *FS) editPaths(ctx context.Context, name string, edit func(map[string]int64)) error {
+	_, err := updatePaths(ctx, f.conf.Retry.newBackoff(ctx), f.bucket.Object(name), nil, func(paths map[string]int64) bool {
+		edit(paths)
+		return true
+	})
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	return err
+}
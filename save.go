@@ -6,8 +6,10 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/crc32"
 	"io"
-	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
@@ -17,221 +19,740 @@ import (
 
 	"cloud.google.com/go/storage"
 	"github.com/bobg/atime/v2"
+	"github.com/bobg/ctrlc"
 	"github.com/cenkalti/backoff/v4"
 	"github.com/pkg/errors"
 	"golang.org/x/time/rate"
 )
 
-func (c maincmd) doSave(ctx context.Context, excludeFrom string, listfile string, args []string) error {
-	var (
-		excludeFilePatterns []*regexp.Regexp
-		excludeDirPatterns  []*regexp.Regexp
-	)
-	if excludeFrom != "" {
-		f, err := os.Open(excludeFrom)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer f.Close()
-		sc := bufio.NewScanner(f)
-		for sc.Scan() {
-			var (
-				line  = sc.Text()
-				isDir bool
-			)
-			if strings.HasSuffix(line, "/") {
-				isDir = true
-				line = line[:len(line)-1]
-				line += "$"
-			}
-
-			regex, err := regexp.Compile(line)
-			if err != nil {
-				log.Fatalf("Compiling exclude pattern %s: %s", sc.Text(), err)
+func (c maincmd) doSave(outerCtx context.Context, excludeFrom string, listfile string, oneFS bool, skipFSTypes, host, stripPrefix string, asVal flag.Value, preHook, postHook, snapshotKind string, resumableSize int64, stateDir string, tmpMaxAge time.Duration, appendList bool, args []string) error {
+	// An interrupt cancels the save,
+	// but the post-hook and snapshot cleanup still run.
+	return ctrlc.Run(outerCtx, func(ctx context.Context) (err error) {
+		if err := checkHost(host); err != nil {
+			return err
+		}
+		if err := checkSnapshotKind(snapshotKind); err != nil {
+			return err
+		}
+
+		rules := *(asVal.(*pathRules))
+		if stripPrefix != "" {
+			if err := rules.add(stripPrefix, "/"); err != nil {
+				return errors.Wrap(err, "in -strip-prefix")
 			}
+		}
 
-			if isDir {
-				excludeDirPatterns = append(excludeDirPatterns, regex)
-			} else {
-				excludeFilePatterns = append(excludeFilePatterns, regex)
+		var roots []string
+		for _, arg := range args {
+			root, err := canonicalPath(arg)
+			if err != nil {
+				return errors.Wrapf(err, "canonicalizing %s", arg)
 			}
+			roots = append(roots, root)
 		}
-		if err := sc.Err(); err != nil {
-			log.Fatal(err)
+		if err := rules.checkCollisions(roots); err != nil {
+			return err
 		}
-	}
 
-	expBkoff := backoff.NewExponentialBackOff()
-	expBkoff.InitialInterval = 10 * time.Second
-	bkoff := backoff.WithMaxRetries(expBkoff, 3)
-	bkoff = backoff.WithContext(bkoff, ctx)
+		s := &saver{
+			maincmd:   c,
+			host:      host,
+			rules:     rules,
+			oneFS:     oneFS,
+			skipTypes: parseFSTypes(skipFSTypes),
+			skipDevs:  make(map[uint64]string),
 
-	f, err := newFS(ctx, c.bucket, listfile, "")
-	if err != nil {
-		return errors.Wrap(err, "in prescan")
-	}
+			resumableSize: resumableSize,
+			stateDir:      stateDir,
 
-	for _, root := range args {
-		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			objects: bucketWriter{bucket: c.bucket},
+		}
+		if s.stateDir == "" {
+			s.stateDir, err = defaultStateDir()
 			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				for _, regex := range excludeDirPatterns {
-					if regex.MatchString(path) {
-						log.Printf("Skipping excluded dir %s", path)
-						return filepath.SkipDir
-					}
-				}
-				return nil
-			}
-			if (info.Mode() & fs.ModeSymlink) == fs.ModeSymlink {
-				log.Printf("Skipping symlink %s", path)
-				return nil
-			}
-			if info.Size() == 0 {
-				log.Printf("Skipping empty file %s", path)
-				return nil
-			}
-			for _, regex := range excludeFilePatterns {
-				if regex.MatchString(path) {
-					log.Printf("Skipping excluded file %s", path)
-					return nil
-				}
+				return errors.Wrap(err, "getting default state dir")
 			}
+		}
 
-			node, err := f.root.findNode(path, false)
+		if excludeFrom != "" {
+			f, err := os.Open(excludeFrom)
 			if err != nil {
-				// Ignore errors.
-				node = nil
-			} else if node.hash == "" {
-				node = nil
+				log.Fatal(err)
 			}
-
-			if node != nil {
-				if uint64(info.Size()) == node.size && !info.ModTime().After(node.timestamp) {
-					log.Printf("Found a prescan size/modtime match for %s", path)
-					return nil
+			defer f.Close()
+			sc := bufio.NewScanner(f)
+			for sc.Scan() {
+				var (
+					line  = sc.Text()
+					isDir bool
+				)
+				if strings.HasSuffix(line, "/") {
+					isDir = true
+					line = line[:len(line)-1]
+					line += "$"
 				}
-			}
 
-			var hash []byte
-			err = atime.WithTimesRestored(path, func(r io.ReadSeeker) error {
-				hasher := sha256.New()
-				_, err = io.Copy(hasher, r)
+				regex, err := regexp.Compile(line)
 				if err != nil {
-					return errors.Wrapf(err, "hashing %s", path)
+					log.Fatalf("Compiling exclude pattern %s: %s", sc.Text(), err)
+				}
+
+				if isDir {
+					s.excludeDirPatterns = append(s.excludeDirPatterns, regex)
+				} else {
+					s.excludeFilePatterns = append(s.excludeFilePatterns, regex)
 				}
-				hash = hasher.Sum(nil)
-				return nil
-			})
-			if err != nil {
-				return err
 			}
+			if err := sc.Err(); err != nil {
+				log.Fatal(err)
+			}
+		}
 
-			name := "sha256-" + hex.EncodeToString(hash)
+		s.bkoff = c.retry.newBackoff(ctx)
 
-			if node != nil && node.hash == name {
-				log.Printf("Found a prescan hash match for %s", path)
-				return nil
-			}
+		s.prescan, err = newFS(ctx, c.bucket, c.retry, listfile, "")
+		if err != nil {
+			return errors.Wrap(err, "in prescan")
+		}
+		if err := s.prescan.wait(); err != nil {
+			return errors.Wrap(err, "in prescan")
+		}
 
-			obj := c.bucket.Object(name)
-			attrs, err := obj.Attrs(ctx)
-			if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
-				return errors.Wrapf(err, "getting attrs for %s (path %s)", name, path)
+		if appendList {
+			if listfile == "" || listfile == "-" {
+				return fmt.Errorf("-append-list requires -list with a filename")
 			}
+			isIndex, err := isIndexFile(listfile)
+			if err != nil {
+				return errors.Wrapf(err, "checking type of %s", listfile)
+			}
+			if isIndex {
+				db, err := openIndexForUpdate(listfile)
+				if err != nil {
+					return err
+				}
+				defer db.Close()
 
-			if errors.Is(err, storage.ErrObjectNotExist) {
-				paths := map[string]int64{
-					path: time.Now().Unix(),
+				s.listOut = func(l listType) error {
+					return appendIndex(ctx, db, l)
 				}
-				j, err := json.Marshal(paths)
+			} else {
+				f, err := os.OpenFile(listfile, os.O_WRONLY|os.O_APPEND, 0)
 				if err != nil {
-					return errors.Wrapf(err, "encoding new paths attr for %s (path %s)", name, path)
+					return errors.Wrapf(err, "opening %s for appending", listfile)
 				}
-				metadata := map[string]string{
-					"paths": string(j),
+				defer f.Close()
+
+				enc := json.NewEncoder(f)
+				enc.SetIndent("", "  ")
+				s.listOut = func(l listType) error {
+					return enc.Encode(l)
 				}
+			}
+		}
 
-				log.Printf("Uploading %s, %d bytes, hash %s", path, info.Size(), name)
-
-				err = withRetries(bkoff, func() error {
-					var w io.WriteCloser = obj.NewWriter(ctx)
-
-					if c.limiter != nil {
-						w = &limitingWriter{ctx: ctx, limiter: c.limiter, w: w}
-					}
-
-					err := atime.WithTimesRestored(path, func(r io.ReadSeeker) error {
-						_, err := io.Copy(w, r)
-						return err
-					})
-					if err != nil {
-						return errors.Wrapf(err, "uploading content for %s (path %s)", name, path)
-					}
-					err = w.Close()
-					return errors.Wrapf(err, "closing upload channel for %s (path %s)", name, path)
-				})
-				if err != nil {
-					return err
+		if preHook != "" {
+			if err := runHook(ctx, "pre", preHook, roots); err != nil {
+				return err
+			}
+		}
+		if postHook != "" {
+			defer func() {
+				if hookErr := runHook(context.WithoutCancel(ctx), "post", postHook, roots); hookErr != nil && err == nil {
+					err = hookErr
 				}
+			}()
+		}
+
+		if tmpMaxAge > 0 {
+			if err := s.sweepTmp(ctx, tmpMaxAge); err != nil {
+				log.Printf("Error deleting old temporary objects: %s", err)
+			}
+		}
 
-				return withRetries(bkoff, func() error {
-					_, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{
-						Metadata: metadata,
-					})
-					return errors.Wrapf(err, "storing attrs for %s (path %s)", name, path)
-				})
+		for _, root := range roots {
+			if err := s.saveRoot(ctx, root, snapshotKind); err != nil {
+				return errors.Wrapf(err, "in walk of %s", root)
 			}
+		}
+
+		if len(s.changed) > 0 {
+			log.Printf("%d file(s) changed while being saved and were skipped:", len(s.changed))
+			for _, path := range s.changed {
+				log.Printf("  %s", path)
+			}
+		}
+
+		return nil
+	})
+}
+
+// saver holds the state for a run of the save subcommand.
+type saver struct {
+	maincmd
+
+	bkoff   backoff.BackOff
+	prescan *FS
+
+	host  string
+	rules pathRules
+
+	excludeFilePatterns []*regexp.Regexp
+	excludeDirPatterns  []*regexp.Regexp
+
+	oneFS     bool
+	skipTypes map[string]bool
+	skipDevs  map[uint64]string // device ID -> filesystem type, or "" if it is not to be skipped
+
+	resumableSize int64  // files at least this large are uploaded in resumable parts; 0 means never
+	stateDir      string // where the state of resumable uploads is kept
+
+	objects objectWriter         // for uploading file content
+	listOut func(listType) error // if non-nil, adds entries for new and updated objects to the list file or index
+
+	changed []string // files that changed while being saved
+}
 
-			var paths map[string]int64
-			if len(attrs.Metadata) == 0 {
-				paths = make(map[string]int64)
+// saveRoot saves the tree at root,
+// first taking a snapshot of it if snapshotKind is non-empty.
+func (s *saver) saveRoot(ctx context.Context, root, snapshotKind string) (err error) {
+	if snapshotKind == "" {
+		return s.walk(ctx, root, root, true)
+	}
+
+	snap, err := makeSnapshot(ctx, snapshotKind, root)
+	if err != nil {
+		return errors.Wrapf(err, "creating %s snapshot", snapshotKind)
+	}
+	defer func() {
+		if cleanupErr := snap.cleanup(context.WithoutCancel(ctx)); cleanupErr != nil {
+			if err == nil {
+				err = cleanupErr
 			} else {
-				if err = json.Unmarshal([]byte(attrs.Metadata["paths"]), &paths); err != nil {
-					return errors.Wrapf(err, "decoding paths attr for %s (path %s)", name, path)
+				log.Printf("Error removing snapshot: %s", cleanupErr)
+			}
+		}
+	}()
+
+	log.Printf("Saving %s from snapshot at %s", root, snap.dir)
+
+	// Files in a read-only snapshot can't have their times restored,
+	// and don't need it.
+	return s.walk(ctx, snap.dir, root, false)
+}
+
+// walk saves the files in the tree at walkRoot,
+// recording them as if they were found at root instead.
+// Normally these are the same,
+// but walkRoot may be a snapshot of root.
+func (s *saver) walk(ctx context.Context, walkRoot, root string, restoreTimes bool) error {
+	var (
+		rootDev  uint64
+		haveRoot bool
+	)
+	return filepath.Walk(walkRoot, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		path := localPath
+		if walkRoot != root {
+			rel, err := filepath.Rel(walkRoot, localPath)
+			if err != nil {
+				return errors.Wrapf(err, "getting path of %s relative to %s", localPath, walkRoot)
+			}
+			path = filepath.Join(root, rel)
+		}
+
+		if info.IsDir() {
+			for _, regex := range s.excludeDirPatterns {
+				if regex.MatchString(path) {
+					log.Printf("Skipping excluded dir %s", path)
+					return filepath.SkipDir
 				}
 			}
 
-			if _, ok := paths[path]; ok {
-				log.Printf("Already present: %s (hash %s)", path, name)
+			dev, ok := devOf(info)
+			if !ok {
 				return nil
 			}
+			if localPath == walkRoot {
+				rootDev, haveRoot = dev, true
+			} else if s.oneFS && haveRoot && dev != rootDev {
+				log.Printf("Skipping dir %s on another filesystem", path)
+				return filepath.SkipDir
+			}
 
-			var oldpaths []string
-			for k := range paths {
-				oldpaths = append(oldpaths, k)
+			typ, ok := s.skipDevs[dev]
+			if !ok {
+				typ, err = fsType(localPath)
+				if err != nil {
+					return errors.Wrapf(err, "getting filesystem type of %s", path)
+				}
+				if !s.skipTypes[typ] {
+					typ = ""
+				}
+				s.skipDevs[dev] = typ
 			}
-			log.Printf("New path for %s (hash %s), already present as %v", path, name, oldpaths)
+			if typ != "" {
+				log.Printf("Skipping dir %s on %s filesystem", path, typ)
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+		if reason := specialFileReason(info.Mode()); reason != "" {
+			log.Printf("Skipping %s %s", reason, path)
+			return nil
+		}
+		if info.Size() == 0 {
+			log.Printf("Skipping empty file %s", path)
+			return nil
+		}
+		for _, regex := range s.excludeFilePatterns {
+			if regex.MatchString(path) {
+				log.Printf("Skipping excluded file %s", path)
+				return nil
+			}
+		}
+
+		return s.saveFile(ctx, localPath, path, info, restoreTimes)
+	})
+}
+
+// saveFile saves the file at localPath,
+// recording it as path.
+func (s *saver) saveFile(ctx context.Context, localPath, path string, info os.FileInfo, restoreTimes bool) error {
+	key := indexKey(s.host, s.rules.apply(path))
+
+	node, err := s.prescan.root.findNode(treePath(key), false)
+	if err != nil {
+		// Ignore errors.
+		node = nil
+	} else if node.hash == "" {
+		node = nil
+	}
+
+	var prev string
+	if node != nil {
+		if uint64(info.Size()) == node.size && !info.ModTime().After(node.timestamp) {
+			log.Printf("Found a prescan size/modtime match for %s", path)
+			return nil
+		}
+		prev = node.hash
+	}
+
+	_, _, err = s.saveAs(ctx, localPath, path, key, prev, info, restoreTimes)
+	return err
+}
 
-			paths[path] = time.Now().Unix()
-			j, err := json.Marshal(paths)
+// saveAs saves the file at localPath under key in its object's paths metadata,
+// unless its hash is prev
+// (the hash of the version already known to be saved under key, if any).
+// The path is where the file is recorded as being, for messages.
+// It returns the name of the file's object
+// and the time recorded for key in its paths metadata,
+// which is zero if the file matched prev.
+// If the file changed while it was being saved,
+// that is reported and the name is "".
+func (s *saver) saveAs(ctx context.Context, localPath, path, key, prev string, info os.FileInfo, restoreTimes bool) (string, time.Time, error) {
+	var (
+		hash []byte
+		crc  uint32
+	)
+	err := readFile(localPath, restoreTimes, func(r io.ReadSeeker) error {
+		var (
+			hasher    = sha256.New()
+			crcHasher = crc32.New(crc32cTable)
+		)
+		_, err := io.Copy(io.MultiWriter(hasher, crcHasher), r)
+		if err != nil {
+			return errors.Wrapf(err, "hashing %s", path)
+		}
+		hash = hasher.Sum(nil)
+		crc = crcHasher.Sum32()
+		return nil
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	state := fileStateOf(info)
+	if restoreTimes {
+		// Restoring a file's times updates its ctime,
+		// so the ctime can't be used to detect changes.
+		state.ctime = time.Time{}
+	}
+	if changed, err := state.changed(localPath); err != nil {
+		return "", time.Time{}, errors.Wrapf(err, "checking %s for changes", path)
+	} else if changed {
+		s.reportChanged(path, "while hashing")
+		return "", time.Time{}, nil
+	}
+
+	name := "sha256-" + hex.EncodeToString(hash)
+
+	if name == prev {
+		log.Printf("Found a prescan hash match for %s", path)
+		return name, time.Time{}, nil
+	}
+
+	obj := s.bucket.Object(name)
+
+	var attrs *storage.ObjectAttrs
+	err = withRetries(s.bkoff, func() error {
+		var err error
+		attrs, err = obj.Attrs(ctx)
+		return err
+	})
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return "", time.Time{}, errors.Wrapf(err, "getting attrs for %s (path %s)", name, path)
+	}
+
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		now := time.Now().Unix()
+		paths := map[string]int64{
+			key: now,
+		}
+		j, err := json.Marshal(paths)
+		if err != nil {
+			return "", time.Time{}, errors.Wrapf(err, "encoding new paths attr for %s (path %s)", name, path)
+		}
+		metadata := map[string]string{
+			"paths": string(j),
+		}
+
+		log.Printf("Uploading %s, %d bytes, hash %s", path, info.Size(), name)
+
+		// Upload to a temporary object,
+		// hashing the content as it streams.
+		// Only if that hash matches the one computed above
+		// does the temporary object get copied to its permanent name.
+
+		tmpObj := s.bucket.Object(tmpName(name))
+		defer s.deleteTmp(ctx, tmpObj)
+
+		u := &upload{
+			localPath:    localPath,
+			path:         path,
+			name:         name,
+			crc:          crc,
+			state:        state,
+			restoreTimes: restoreTimes,
+		}
+		if s.resumableSize > 0 && info.Size() >= s.resumableSize {
+			err = s.uploadResumable(ctx, tmpObj, u)
+		} else {
+			err = s.uploadSimple(ctx, tmpObj.ObjectName(), u)
+		}
+		if errors.Is(err, errFileChanged) {
+			s.reportChanged(path, "while uploading")
+			return "", time.Time{}, nil
+		}
+		if err != nil {
+			return "", time.Time{}, err
+		}
+
+		var newAttrs *storage.ObjectAttrs
+		err = withRetries(s.bkoff, func() error {
+			copier := obj.CopierFrom(tmpObj)
+			copier.Metadata = metadata
+			attrs, err := copier.Run(ctx)
 			if err != nil {
-				return errors.Wrapf(err, "encoding updated paths attr for %s (path %s)", name, path)
+				return errors.Wrapf(err, "copying %s to %s (path %s)", tmpObj.ObjectName(), name, path)
 			}
-			metadata := map[string]string{
-				"paths": string(j),
+			if attrs.CRC32C != crc {
+				return errors.Wrapf(errChecksumMismatch, "copying %s to %s (path %s): got CRC32C %08x, want %08x", tmpObj.ObjectName(), name, path, attrs.CRC32C, crc)
 			}
+			newAttrs = attrs
+			return nil
+		})
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		return name, time.Unix(now, 0), s.appendList(newAttrs)
+	}
 
-			return withRetries(bkoff, func() error {
-				_, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{
-					Metadata: metadata,
-				})
-				return errors.Wrapf(err, "updating attrs for %s (path %s)", name, path)
+	if attrs.CRC32C != crc {
+		log.Printf("WARNING: stored object %s has CRC32C %08x, but %s has %08x", name, attrs.CRC32C, path, crc)
+	}
+
+	var (
+		now   = time.Now().Unix()
+		saved int64
+	)
+	newAttrs, err := updatePaths(ctx, s.bkoff, obj, attrs, func(paths map[string]int64) bool {
+		if ts, ok := paths[key]; ok {
+			saved = ts
+			return false
+		}
+
+		var oldpaths []string
+		for k := range paths {
+			oldpaths = append(oldpaths, k)
+		}
+		log.Printf("New path for %s (hash %s), already present as %v", path, name, oldpaths)
+
+		paths[key] = now
+		saved = now
+		return true
+	})
+	if err != nil {
+		return "", time.Time{}, errors.Wrapf(err, "adding path %s", path)
+	}
+	if newAttrs == nil {
+		log.Printf("Already present: %s (hash %s)", path, name)
+		return name, time.Unix(saved, 0), nil
+	}
+	return name, time.Unix(saved, 0), s.appendList(newAttrs)
+}
+
+// maxEditAttempts is how many times updatePaths tries its edit
+// when the metadata keeps changing underneath it.
+const maxEditAttempts = 5
+
+// updatePaths changes the paths metadata of obj,
+// whose attributes are attrs (which are fetched if attrs is nil).
+// It calls edit to change the decoded metadata,
+// which returns false if nothing needs changing.
+// The update is made only if the metadata has not changed since it was read
+// (as it might, for instance, by a concurrent save or a change through fs -rw);
+// if it has, it is read again and edit is called again.
+// The result is obj's updated attributes,
+// or nil if edit returned false.
+func updatePaths(ctx context.Context, bkoff backoff.BackOff, obj *storage.ObjectHandle, attrs *storage.ObjectAttrs, edit func(map[string]int64) bool) (*storage.ObjectAttrs, error) {
+	name := obj.ObjectName()
+	for attempt := 1; ; attempt++ {
+		if attrs == nil {
+			err := withRetries(bkoff, func() error {
+				var err error
+				attrs, err = obj.Attrs(ctx)
+				return err
 			})
+			if err != nil {
+				return nil, errors.Wrapf(err, "getting attrs for %s", name)
+			}
+		}
+
+		paths := make(map[string]int64)
+		if j := attrs.Metadata["paths"]; j != "" {
+			if err := json.Unmarshal([]byte(j), &paths); err != nil {
+				return nil, errors.Wrapf(err, "decoding paths attr for %s", name)
+			}
+		}
+		if !edit(paths) {
+			return nil, nil
+		}
+		j, err := json.Marshal(paths)
+		if err != nil {
+			return nil, errors.Wrapf(err, "encoding updated paths attr for %s", name)
+		}
+
+		var newAttrs *storage.ObjectAttrs
+		err = withRetries(bkoff, func() error {
+			var err error
+			newAttrs, err = obj.If(storage.Conditions{MetagenerationMatch: attrs.Metageneration}).Update(ctx, storage.ObjectAttrsToUpdate{
+				Metadata: map[string]string{"paths": string(j)},
+			})
+			return err
 		})
+		if isPreconditionFailed(err) && attempt < maxEditAttempts {
+			attrs = nil
+			continue
+		}
 		if err != nil {
-			return errors.Wrapf(err, "in walk of %s", root)
+			return nil, errors.Wrapf(err, "updating attrs for %s", name)
 		}
+		return newAttrs, nil
+	}
+}
+
+// appendList adds an entry for a new or updated object to the list file,
+// if save was run with -append-list.
+func (s *saver) appendList(attrs *storage.ObjectAttrs) error {
+	if s.listOut == nil {
+		return nil
+	}
+	entry, err := listEntry(attrs)
+	if err != nil {
+		return err
 	}
+	return errors.Wrapf(s.listOut(entry), "appending %s to list file", attrs.Name)
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// errChecksumMismatch means the checksum of an object in the bucket
+	// did not match the checksum of the content that was uploaded.
+	// It is treated as a transient failure and retried.
+	errChecksumMismatch = errors.New("checksum mismatch")
+
+	// errFileChanged means a file changed while it was being saved.
+	errFileChanged = errors.New("file changed")
+)
+
+// tmpPrefix is the prefix of the names of temporary objects,
+// which hold uploads until their content has been verified.
+const tmpPrefix = "tmp/"
+
+// tmpName produces a unique temporary object name for an upload of the object with the given name.
+func tmpName(name string) string {
+	return fmt.Sprintf("%s%s-%d-%d", tmpPrefix, name, os.Getpid(), time.Now().UnixNano())
+}
+
+// reportChanged logs that the file at path changed while it was being saved,
+// and remembers it for the summary at the end of the run.
+func (s *saver) reportChanged(path, when string) {
+	log.Printf("Skipping %s, which changed %s", path, when)
+	s.changed = append(s.changed, path)
+}
+
+// fileState is the information used to tell whether a file has changed.
+// A zero ctime is not compared.
+type fileState struct {
+	size         int64
+	mtime, ctime time.Time
+}
+
+func fileStateOf(info os.FileInfo) fileState {
+	return fileState{
+		size:  info.Size(),
+		mtime: info.ModTime(),
+		ctime: ctimeOf(info),
+	}
+}
+
+// changed tells whether the file at path no longer matches st.
+func (st fileState) changed(path string) (bool, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false, err
+	}
+	other := fileStateOf(info)
+	if other.size != st.size || !other.mtime.Equal(st.mtime) {
+		return true, nil
+	}
+	return !st.ctime.IsZero() && !other.ctime.Equal(st.ctime), nil
+}
+
+// upload describes a file being uploaded.
+type upload struct {
+	localPath    string // where the file is
+	path         string // where the file is recorded as being
+	name         string // the name of the object to create
+	crc          uint32 // the CRC32C of the file's content
+	state        fileState
+	restoreTimes bool
+}
 
+// uploadSimple uploads a file to the object with the given name in a single request,
+// checking that its content still hashes to u.name.
+func (s *saver) uploadSimple(ctx context.Context, objName string, u *upload) error {
+	var streamed string
+	err := withRetries(s.bkoff, func() error {
+		// Sending the CRC32C computed while hashing
+		// causes the server to reject content that doesn't match it.
+		uw := s.objects.NewWriter(ctx, objName, u.crc, true)
+
+		var w io.WriteCloser = uw
+		if s.limiter != nil {
+			w = &limitingWriter{ctx: ctx, limiter: s.limiter, w: w}
+		}
+
+		hasher := sha256.New()
+		err := readFile(u.localPath, u.restoreTimes, func(r io.ReadSeeker) error {
+			_, err := io.Copy(w, io.TeeReader(r, hasher))
+			return err
+		})
+		if err != nil {
+			return errors.Wrapf(err, "uploading content for %s (path %s)", u.name, u.path)
+		}
+		streamed = "sha256-" + hex.EncodeToString(hasher.Sum(nil))
+		if err = w.Close(); err != nil {
+			// The server rejects content whose CRC32C doesn't match,
+			// as when the file changed after it was hashed.
+			// The file's times can't be relied on to tell
+			// (they may have been restored by readFile),
+			// but its content can.
+			if streamed != u.name {
+				return backoff.Permanent(errFileChanged)
+			}
+			if changed, _ := u.state.changed(u.localPath); changed {
+				return backoff.Permanent(errFileChanged)
+			}
+			return errors.Wrapf(err, "closing upload channel for %s (path %s)", u.name, u.path)
+		}
+		if got := uw.CRC32C(); got != u.crc {
+			return errors.Wrapf(errChecksumMismatch, "uploading %s (path %s): got CRC32C %08x, want %08x", u.name, u.path, got, u.crc)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if streamed != u.name {
+		return errFileChanged
+	}
 	return nil
 }
 
-func withRetries(bkoff backoff.BackOff, f func() error) error {
-	bkoff.Reset()
-	return backoff.Retry(f, bkoff) // The backoff API gets the order of these arguments wrong.
+// objectWriter creates bucket objects.
+// The saver uploads file content through one of these,
+// which is a bucketWriter except in tests.
+type objectWriter interface {
+	// NewWriter returns a writer for the content of the named object.
+	// If sendCRC is true,
+	// the object is created only if its content has the given CRC32C.
+	NewWriter(ctx context.Context, name string, crc uint32, sendCRC bool) uploadWriter
+}
+
+// uploadWriter writes the content of a new object.
+type uploadWriter interface {
+	io.WriteCloser
+
+	// CRC32C returns the checksum of the object as stored.
+	// It is valid only after a successful Close.
+	CRC32C() uint32
+}
+
+// bucketWriter is the objectWriter for a bucket.
+type bucketWriter struct {
+	bucket *storage.BucketHandle
+}
+
+func (b bucketWriter) NewWriter(ctx context.Context, name string, crc uint32, sendCRC bool) uploadWriter {
+	w := b.bucket.Object(name).NewWriter(ctx)
+	w.CRC32C = crc
+	w.SendCRC32C = sendCRC
+	return storageWriter{w}
+}
+
+type storageWriter struct {
+	*storage.Writer
+}
+
+func (w storageWriter) CRC32C() uint32 {
+	return w.Attrs().CRC32C
+}
+
+// readFile opens the file at path and passes it to a callback.
+// If restoreTimes is true,
+// the file's atime and mtime are restored afterward.
+func readFile(path string, restoreTimes bool, fn func(io.ReadSeeker) error) error {
+	if restoreTimes {
+		return atime.WithTimesRestored(path, fn)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fn(f)
 }
 
 type limitingWriter struct {
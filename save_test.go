@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/crc32"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestUploadSimple(t *testing.T) {
+	ctx := context.Background()
+	rnd := rand.New(rand.NewSource(1))
+
+	cases := []struct {
+		name         string
+		restoreTimes bool
+		change       bool
+	}{
+		{name: "unchanged"},
+		{name: "unchanged_restore_times", restoreTimes: true},
+		{name: "changed", change: true},
+		{name: "changed_restore_times", restoreTimes: true, change: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var (
+				content   = randomBytes(rnd, 100000)
+				localPath = filepath.Join(t.TempDir(), "file")
+			)
+			if err := os.WriteFile(localPath, content, 0600); err != nil {
+				t.Fatal(err)
+			}
+			mtime := time.Unix(1700000000, 0)
+			if err := os.Chtimes(localPath, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Lstat(localPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sum := sha256.Sum256(content)
+			u := &upload{
+				localPath:    localPath,
+				path:         localPath,
+				name:         "sha256-" + hex.EncodeToString(sum[:]),
+				crc:          crc32.Checksum(content, crc32cTable),
+				state:        fileStateOf(info),
+				restoreTimes: c.restoreTimes,
+			}
+			if c.restoreTimes {
+				// As in saveAs.
+				u.state.ctime = time.Time{}
+			}
+
+			if c.change {
+				// Change the file in place after hashing,
+				// leaving its size and mtime as they were
+				// (as when its times are restored).
+				changed := bytes.Clone(content)
+				changed[len(changed)/2]++
+				if err := os.WriteFile(localPath, changed, 0600); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(localPath, mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			fake := newFakeObjects(false, nil)
+			s := &saver{
+				bkoff: retryConf{
+					Retries: 10,
+					Initial: time.Microsecond,
+					Max:     time.Millisecond,
+				}.newBackoff(ctx),
+				objects: fake,
+			}
+
+			const objName = "tmp/upload"
+			err = s.uploadSimple(ctx, objName, u)
+			if c.change {
+				if !errors.Is(err, errFileChanged) {
+					t.Fatalf("got error %v, want %v", err, errFileChanged)
+				}
+				if fake.writes != 1 {
+					t.Errorf("got %d write attempts, want 1", fake.writes)
+				}
+				if _, ok := fake.objects[objName]; ok {
+					t.Error("object was created")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(fake.objects[objName], content) {
+				t.Error("object content differs from file content")
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// snapshot is a read-only snapshot of a directory tree.
+type snapshot struct {
+	// dir is where the snapshotted tree can be found.
+	dir string
+
+	// cleanup removes the snapshot.
+	cleanup func(context.Context) error
+}
+
+func checkSnapshotKind(kind string) error {
+	switch kind {
+	case "", "btrfs", "zfs":
+		return nil
+	default:
+		return fmt.Errorf("unknown snapshot kind %s (want btrfs or zfs)", kind)
+	}
+}
+
+// makeSnapshot creates a read-only snapshot of the filesystem containing root
+// and returns the location of root within it.
+// The kind is "btrfs" or "zfs".
+func makeSnapshot(ctx context.Context, kind, root string) (*snapshot, error) {
+	// Both btrfs subvolumes and zfs datasets have their own device IDs,
+	// so this finds the subvolume or dataset to snapshot.
+	top, err := topOfDevice(root)
+	if err != nil {
+		return nil, errors.Wrapf(err, "finding filesystem containing %s", root)
+	}
+	rel, err := filepath.Rel(top, root)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting path of %s relative to %s", root, top)
+	}
+
+	snapName := fmt.Sprintf("gcsbackup-%d", time.Now().Unix())
+
+	switch kind {
+	case "btrfs":
+		snapDir := filepath.Join(top, "."+snapName)
+		if _, err := runCmd(ctx, "btrfs", "subvolume", "snapshot", "-r", top, snapDir); err != nil {
+			return nil, err
+		}
+		return &snapshot{
+			dir: filepath.Join(snapDir, rel),
+			cleanup: func(ctx context.Context) error {
+				_, err := runCmd(ctx, "btrfs", "subvolume", "delete", snapDir)
+				return err
+			},
+		}, nil
+
+	case "zfs":
+		out, err := runCmd(ctx, "zfs", "list", "-H", "-o", "name", top)
+		if err != nil {
+			return nil, err
+		}
+		dataset := strings.TrimSpace(out)
+		if dataset == "" {
+			return nil, fmt.Errorf("no zfs dataset mounted at %s", top)
+		}
+		fullName := dataset + "@" + snapName
+		if _, err := runCmd(ctx, "zfs", "snapshot", fullName); err != nil {
+			return nil, err
+		}
+		return &snapshot{
+			dir: filepath.Join(top, ".zfs", "snapshot", snapName, rel),
+			cleanup: func(ctx context.Context) error {
+				_, err := runCmd(ctx, "zfs", "destroy", fullName)
+				return err
+			},
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown snapshot kind %s", kind)
+}
+
+// topOfDevice returns the topmost ancestor of path
+// that is on the same device as path.
+func topOfDevice(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	dev, ok := devOf(info)
+	if !ok {
+		return "", fmt.Errorf("cannot get device of %s", path)
+	}
+	for {
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path, nil
+		}
+		info, err := os.Stat(parent)
+		if err != nil {
+			return "", err
+		}
+		if parentDev, _ := devOf(info); parentDev != dev {
+			return path, nil
+		}
+		path = parent
+	}
+}
+
+// runHook runs a shell command before or after a save.
+// The roots being saved are passed to it as positional parameters,
+// and the variable GCSBACKUP_HOOK is set to "pre" or "post" in its environment.
+func runHook(ctx context.Context, which, command string, roots []string) error {
+	log.Printf("Running %s-hook: %s", which, command)
+
+	args := append([]string{"-c", command, "gcsbackup"}, roots...)
+	cmd := exec.CommandContext(ctx, "sh", args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "GCSBACKUP_HOOK="+which)
+	return errors.Wrapf(cmd.Run(), "running %s-hook", which)
+}
+
+// runCmd runs a command and returns its standard output.
+func runCmd(ctx context.Context, name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.Wrapf(err, "running %s %s: %s", name, strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
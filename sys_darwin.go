@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// fsType returns the name of the type of filesystem containing path.
+func fsType(path string) (string, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return "", err
+	}
+	var buf []byte
+	for _, ch := range st.Fstypename {
+		if ch == 0 {
+			break
+		}
+		buf = append(buf, byte(ch))
+	}
+	return string(buf), nil
+}
+
+// diskSpace returns the free space, in bytes, of the filesystem containing path,
+// and the part of it available to unprivileged users.
+func diskSpace(path string) (free, avail uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Bfree * uint64(st.Bsize), st.Bavail * uint64(st.Bsize), nil
+}
+
+// ctimeOf returns the inode change time of the file described by info,
+// or the zero time if it is not available.
+func ctimeOf(info fs.FileInfo) time.Time {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(st.Ctimespec.Unix())
+}
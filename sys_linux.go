@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// Filesystem magic numbers from statfs(2).
+// They are 32-bit values,
+// which Statfs_t.Type holds as a signed int32 on some platforms.
+var fsTypeNames = map[uint32]string{
+	0x0187:     "autofs",
+	0x01021994: "tmpfs",
+	0x01021997: "9p",
+	0x1cd1:     "devpts",
+	0x27e0eb:   "cgroup",
+	0x2fc12fc1: "zfs",
+	0x4d44:     "vfat",
+	0x42494e4d: "binfmt_misc",
+	0x517b:     "smb",
+	0x58465342: "xfs",
+	0x5346544e: "ntfs",
+	0x6165676c: "pstore",
+	0x62656570: "configfs",
+	0x62656572: "sysfs",
+	0x63677270: "cgroup2",
+	0x64626720: "debugfs",
+	0x65735543: "fusectl",
+	0x65735546: "fuse",
+	0x67596969: "rpc_pipefs",
+	0x6969:     "nfs",
+	0x6e736673: "nsfs",
+	0x73636673: "securityfs",
+	0x73717368: "squashfs",
+	0x74726163: "tracefs",
+	0x794c7630: "overlay",
+	0x858458f6: "ramfs",
+	0x9123683e: "btrfs",
+	0x958458f6: "hugetlbfs",
+	0x9660:     "iso9660",
+	0x9fa0:     "proc",
+	0x19800202: "mqueue",
+	0xcafe4a11: "bpf",
+	0xde5e81e4: "efivarfs",
+	0xef53:     "ext4",
+	0xf97cff8c: "selinuxfs",
+	0xfe534d42: "smb2",
+	0xff534d42: "cifs",
+}
+
+// fsType returns the name of the type of filesystem containing path.
+func fsType(path string) (string, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return "", err
+	}
+	typ := uint32(st.Type)
+	if name, ok := fsTypeNames[typ]; ok {
+		return name, nil
+	}
+	return fmt.Sprintf("0x%x", typ), nil
+}
+
+// diskSpace returns the free space, in bytes, of the filesystem containing path,
+// and the part of it available to unprivileged users.
+func diskSpace(path string) (free, avail uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Bfree * uint64(st.Bsize), st.Bavail * uint64(st.Bsize), nil
+}
+
+// ctimeOf returns the inode change time of the file described by info,
+// or the zero time if it is not available.
+func ctimeOf(info fs.FileInfo) time.Time {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(st.Ctim.Unix())
+}
@@ -0,0 +1,27 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"io/fs"
+	"time"
+)
+
+// fsType returns the name of the type of filesystem containing path.
+// On this platform it is not known.
+func fsType(path string) (string, error) {
+	return "", nil
+}
+
+// diskSpace returns the free space, in bytes, of the filesystem containing path,
+// and the part of it available to unprivileged users.
+// On this platform it is not known.
+func diskSpace(path string) (free, avail uint64, err error) {
+	return 0, 0, nil
+}
+
+// ctimeOf returns the inode change time of the file described by info.
+// On this platform it is not known.
+func ctimeOf(info fs.FileInfo) time.Time {
+	return time.Time{}
+}